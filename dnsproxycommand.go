@@ -7,15 +7,19 @@ package main
  * OpenSSH ProxyCommand using SSH
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220324
+ * Last Modified 20260730
  */
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/magisterquis/dnsproxycommand/internal/client"
@@ -51,6 +55,106 @@ func main() {
 			time.Minute,
 			"Dead connection prune `interval`",
 		)
+		dohListen = flag.String(
+			"doh-listen",
+			"",
+			"Optional DoH (RFC 8484) server listen `address`",
+		)
+		dohUpstream = flag.String(
+			"doh-upstream",
+			"",
+			"Optional DoH (RFC 8484) upstream `URL`, for client mode",
+		)
+		cert = flag.String(
+			"cert",
+			"",
+			"TLS certificate `file` for -doh-listen (else autocert)",
+		)
+		key = flag.String(
+			"key",
+			"",
+			"TLS key `file` for -doh-listen (else autocert)",
+		)
+		cryptKey = flag.String(
+			"crypt-key",
+			"",
+			"Server: static private key `file`; client: pinned "+
+				"server public key `file` (hex, either way; "+
+				"generated/logged if omitted server-side)",
+		)
+		insecure = flag.Bool(
+			"insecure",
+			false,
+			"Disable tunnel encryption, for compatibility with "+
+				"older clients/servers",
+		)
+		apexNS = flag.String(
+			"apex-ns",
+			"",
+			"Server: comma-separated NS hostnames to answer "+
+				"for the zone apex",
+		)
+		apexA = flag.String(
+			"apex-a",
+			"",
+			"Server: comma-separated A `addresses` to answer "+
+				"for the zone apex",
+		)
+		apexAAAA = flag.String(
+			"apex-aaaa",
+			"",
+			"Server: comma-separated AAAA `addresses` to answer "+
+				"for the zone apex",
+		)
+		apexCAAIssue = flag.String(
+			"apex-caa-issue",
+			"",
+			"Server: sole CAA issuer `domain` to answer for the "+
+				"zone apex (none, if unset)",
+		)
+		apexSOAEmail = flag.String(
+			"apex-soa-email",
+			"",
+			"Server: SOA responsible-party `email` (dotted "+
+				"form; defaults to hostmaster.<domain>)",
+		)
+		apexTTL = flag.Duration(
+			"apex-ttl",
+			5*time.Minute,
+			"Server: TTL `interval` for zone apex records",
+		)
+		apexUpstream = flag.String(
+			"apex-upstream",
+			"",
+			"Server: optional upstream recursor `address` to "+
+				"which non-tunnel apex queries are forwarded",
+		)
+		querylog = flag.String(
+			"querylog",
+			"",
+			"Server: optional structured query log `file`",
+		)
+		querylogFormat = flag.String(
+			"querylog-format",
+			"tab",
+			"Server: query log `format` (tab or json)",
+		)
+		querylogMaxSize = flag.Int64(
+			"querylog-max-size",
+			100*1024*1024,
+			"Server: query log rotation `size`, in bytes",
+		)
+		qps = flag.Float64(
+			"qps",
+			0,
+			"Server: per-client-IP query rate limit, in `queries` "+
+				"per second (disabled if 0)",
+		)
+		metricsListen = flag.String(
+			"metrics-listen",
+			"",
+			"Server: optional Prometheus /metrics `address`",
+		)
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
@@ -75,28 +179,166 @@ Options:
 	/* Work out whether we're a client or server. */
 	switch flag.NArg() {
 	case 0: /* Client */
-		fwd, rev, err := client.Client(Domain, *pollMax)
-		log.Printf(
-			"Finished proxying after %s: %d bytes forward, %d bytes reverse, %d total",
-			time.Since(start).Round(time.Millisecond),
-			fwd,
-			rev,
-			fwd+rev,
-		)
+		runClient(start, *pollMax, *dohUpstream, *cryptKey, *insecure)
+	case 1: /* Server */
+		a, err := parseIPs(*apexA)
 		if nil != err {
-			log.Fatalf("Fatal error: %s", err)
+			log.Fatalf("Parsing -apex-a: %s", err)
 		}
-	case 1: /* Server */
-		log.Fatalf(
-			"Fatal error: %s",
-			server.Server(
-				flag.Arg(0),
-				*laddr,
-				Domain,
-				*pruneInterval,
-			),
-		)
+		aaaa, err := parseIPs(*apexAAAA)
+		if nil != err {
+			log.Fatalf("Parsing -apex-aaaa: %s", err)
+		}
+		qlFormat, err := parseQueryLogFormat(*querylogFormat)
+		if nil != err {
+			log.Fatalf("Parsing -querylog-format: %s", err)
+		}
+		runServer(flag.Arg(0), *laddr, server.Options{
+			PruneInterval: *pruneInterval,
+			DoHListen:     *dohListen,
+			Cert:          *cert,
+			Key:           *key,
+			CryptKeyFile:  *cryptKey,
+			Insecure:      *insecure,
+			Apex: server.ApexRecords{
+				NS:               splitCSV(*apexNS),
+				A:                a,
+				AAAA:             aaaa,
+				CAAIssue:         *apexCAAIssue,
+				SOAEmail:         *apexSOAEmail,
+				TTL:              *apexTTL,
+				UpstreamRecursor: *apexUpstream,
+			},
+			QueryLogFile:    *querylog,
+			QueryLogFormat:  qlFormat,
+			QueryLogMaxSize: *querylogMaxSize,
+			QPS:             *qps,
+			MetricsListen:   *metricsListen,
+		})
 	default: /* Error. */
 		log.Fatalf("Too many command-line arguments")
 	}
 }
+
+/* splitCSV splits s on commas, trimming whitespace from each field and
+dropping empty fields.  An empty s yields a nil slice. */
+func splitCSV(s string) []string {
+	if "" == s {
+		return nil
+	}
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if "" != f {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+/* parseQueryLogFormat parses the -querylog-format flag. */
+func parseQueryLogFormat(s string) (server.QueryLogFormat, error) {
+	switch s {
+	case "tab":
+		return server.QueryLogTab, nil
+	case "json":
+		return server.QueryLogJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown format %q (want tab or json)", s)
+	}
+}
+
+/* parseIPs is splitCSV followed by net.ParseIP on each field. */
+func parseIPs(s string) ([]net.IP, error) {
+	fs := splitCSV(s)
+	if nil == fs {
+		return nil, nil
+	}
+	ips := make([]net.IP, 0, len(fs))
+	for _, f := range fs {
+		ip := net.ParseIP(f)
+		if nil == ip {
+			return nil, fmt.Errorf("invalid address %q", f)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+/* runClient dials the DPC server for Domain and proxies stdio over the
+returned net.Conn until either side's done. */
+func runClient(start time.Time, pollMax time.Duration, dohUpstream, cryptKey string, insecure bool) {
+	conn, err := client.Dial(context.Background(), Domain, client.Options{
+		Poll:         pollMax,
+		DoHUpstream:  dohUpstream,
+		CryptKeyFile: cryptKey,
+		Insecure:     insecure,
+	})
+	if nil != err {
+		log.Fatalf("Fatal error: %s", err)
+	}
+
+	var fwd, rev int64
+	done := make(chan error, 2)
+	go func() {
+		var err error
+		fwd, err = io.Copy(conn, os.Stdin)
+		done <- err
+	}()
+	go func() {
+		var err error
+		rev, err = io.Copy(os.Stdout, conn)
+		done <- err
+	}()
+	err = <-done
+	conn.Close()
+	<-done /* Wait for the other copy to unblock (conn's now closed)
+	before reading fwd/rev below; otherwise it may still be writing them
+	when we do. */
+
+	log.Printf(
+		"Finished proxying after %s: %d bytes forward, %d bytes reverse, %d total",
+		time.Since(start).Round(time.Millisecond),
+		fwd,
+		rev,
+		fwd+rev,
+	)
+	if nil != err {
+		log.Fatalf("Fatal error: %s", err)
+	}
+}
+
+/* runServer listens for DPC clients for Domain on laddr per opts and proxies
+each accepted connection to caddr. */
+func runServer(caddr, laddr string, opts server.Options) {
+	l, err := server.Listen(Domain, laddr, opts)
+	if nil != err {
+		log.Fatalf("Fatal error: %s", err)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if nil != err {
+			log.Fatalf("Fatal error: %s", err)
+		}
+		go proxyToUpstream(conn, caddr)
+	}
+}
+
+/* proxyToUpstream dials caddr and proxies conn to it in both directions,
+closing both when either side's done. */
+func proxyToUpstream(conn net.Conn, caddr string) {
+	defer conn.Close()
+
+	up, err := net.Dial("tcp", caddr)
+	if nil != err {
+		log.Printf("[%s] Dialing %s: %s", conn.RemoteAddr(), caddr, err)
+		return
+	}
+	defer up.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(up, conn); done <- struct{}{} }()
+	go func() { io.Copy(conn, up); done <- struct{}{} }()
+	<-done
+}
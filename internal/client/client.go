@@ -6,27 +6,32 @@ package client
  * Client side of dnsproxycommand
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220324
+ * Last Modified 20260730
  */
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
 	"encoding/base32"
 	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"net"
-	"os"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 const (
 	/* rbuflen is the read buffer length.  It corresponds to <=63 base32'd
 	characters. */
 	rBufLen = 39
+	/* rBufLenSecure is rBufLen, less room for the AEAD's tag, for when
+	payloads are encrypted (see crypto.go). */
+	rBufLenSecure = rBufLen - 16
 	/* maxLabelLen is the maximum length of a DNS label. */
 	maxLabelLen = 63
 	/* pollIncFactor is the maximum by which a poll interval will
@@ -34,6 +39,10 @@ const (
 	pollIncFactor = 1.5
 	/* pollMin is the minimum poll interval. */
 	pollMin = time.Nanosecond
+
+	/* defaultPoll is the maximum poll interval used if Options.Poll is
+	unset. */
+	defaultPoll = 5 * time.Second
 )
 
 /* Coders. */
@@ -44,20 +53,65 @@ var (
 
 /* client represents a DPC client. */
 type client struct {
-	fwd    uint64
-	rev    uint64
+	ctx context.Context
+
 	domain string
 
+	/* conn is the local end of the net.Pipe whose remote end is handed
+	back to the caller of Dial; proxyForward/proxyBack read/write it in
+	place of stdio. */
+	conn net.Conn
+
+	/* dohUpstream is the DoH server URL to use for queries instead of
+	the system resolver.  If empty, plain UDP/53 lookups are used. */
+	dohUpstream string
+
+	/* insecure disables the tunnel encryption layer entirely, for
+	compatibility with older servers. */
+	insecure bool
+
+	/* pinnedServerPub, if set, is the server public key we require the
+	handshake to present, loaded from the -crypt-key file. */
+	pinnedServerPub *ecdh.PublicKey
+
+	/* fwdKey and revKey are this connection's AEAD keys, set by
+	handshake unless insecure is true. */
+	fwdKey []byte
+	revKey []byte
+
+	/* recType is the RR type used for reverse-path (server-to-client)
+	queries, set by negotiateRecType in rrpack.go. */
+	recType dnsmessage.Type
+
 	/* Maximum and current poll intervals. */
 	pollMax time.Duration
 	pollCur time.Duration
 }
 
-/* query makes a TXT query with the given payload and returns the TXT record.
-If there is more than one, query returns an error. */
+/* query makes a query with the given payload and returns the decoded
+reverse-path payload.  It proxies to queryDoH, or, over plain DNS, to
+queryTXT/queryAAAA/queryCNAME depending on c.recType (see rrpack.go;
+queryDoH always uses TXT). */
 func (c *client) query(sd string) ([]byte, error) {
+	if "" != c.dohUpstream {
+		return c.queryDoH(sd)
+	}
+	switch c.recType {
+	case dnsmessage.TypeAAAA:
+		return c.queryAAAA(sd)
+	case dnsmessage.TypeCNAME:
+		return c.queryCNAME(sd)
+	default:
+		return c.queryTXT(sd)
+	}
+}
+
+/* queryTXT makes a TXT query with the given payload via the system resolver
+and returns the TXT record.  If there is more than one, queryTXT returns an
+error. */
+func (c *client) queryTXT(sd string) ([]byte, error) {
 	/* Send it off and get a reply. */
-	txts, err := net.LookupTXT(sd + c.domain)
+	txts, err := net.DefaultResolver.LookupTXT(c.ctx, sd+c.domain)
 	if nil != err {
 		return nil, fmt.Errorf("querying for %q: %w", sd, err)
 	}
@@ -89,14 +143,65 @@ func (c *client) query(sd string) ([]byte, error) {
 }
 
 /* handshake tells the server we want to communicate and gets an ID.  c's
-domain is updated with the ID.  handshake must not be called concurrently with
-any other of c's methods. */
+domain is updated with the ID.  Unless c.insecure is set, handshake also
+performs an X25519 key exchange with the server and sets c.fwdKey/c.revKey,
+so that forward/reverse payloads are authenticated and encrypted.  handshake
+must not be called concurrently with any other of c's methods. */
 func (c *client) handshake() error {
-	/* Ask server for an ID. */
-	id, err := c.query(fmt.Sprintf("%d", time.Now().UnixNano()))
+	var (
+		sd   string
+		priv *ecdh.PrivateKey
+	)
+	if c.insecure {
+		sd = fmt.Sprintf("%d", time.Now().UnixNano())
+	} else {
+		var err error
+		priv, err = genKeypair()
+		if nil != err {
+			return fmt.Errorf("generating keypair: %w", err)
+		}
+		sd = fmt.Sprintf(
+			"%s-%s",
+			strconv.FormatInt(time.Now().Unix(), 36),
+			b32enc(priv.PublicKey().Bytes()),
+		)
+	}
+
+	/* Ask server for an ID (and, if we're not insecure, its public
+	key). */
+	resp, err := c.query(sd)
 	if nil != err {
 		return err
 	}
+	if 0 == len(resp) {
+		return fmt.Errorf("empty response from server")
+	}
+
+	var id []byte
+	if c.insecure {
+		id = resp
+	} else {
+		pubLen := x25519PubLen
+		if len(resp) < pubLen {
+			return fmt.Errorf("short handshake response from server")
+		}
+		serverPub, err := ecdh.X25519().NewPublicKey(resp[:pubLen])
+		if nil != err {
+			return fmt.Errorf("parsing server public key: %w", err)
+		}
+		if nil != c.pinnedServerPub && !bytes.Equal(
+			serverPub.Bytes(),
+			c.pinnedServerPub.Bytes(),
+		) {
+			return fmt.Errorf("server public key doesn't match pinned key")
+		}
+		secret, err := priv.ECDH(serverPub)
+		if nil != err {
+			return fmt.Errorf("computing shared secret: %w", err)
+		}
+		c.fwdKey, c.revKey = deriveKeys(secret)
+		id = resp[pubLen:]
+	}
 	if 0 == len(id) {
 		return fmt.Errorf("empty ID from server")
 	}
@@ -106,38 +211,51 @@ func (c *client) handshake() error {
 	return nil
 }
 
-/* proxyForward proxies from stdin to the DNS server. */
+/* proxyForward proxies from c.conn to the DNS server. */
 func (c *client) proxyForward(done chan<- error) {
+	bl := rBufLen
+	if nil != c.fwdKey {
+		bl = rBufLenSecure
+	}
 	var (
 		qn  uint64 /* Query counter. */
-		buf = make([]byte, rBufLen)
+		buf = make([]byte, bl)
 		qb  bytes.Buffer
 	)
 	for {
 		/* Read a chunk to send. */
-		n, rerr := os.Stdin.Read(buf)
+		n, rerr := c.conn.Read(buf)
 		if 0 != n { /* Got something. */
+			/* Encrypt, if we're not insecure. */
+			chunk := buf[:n]
+			if nil != c.fwdKey {
+				eb, eerr := seal(c.fwdKey, qn, false, chunk)
+				if nil != eerr {
+					done <- fmt.Errorf("encrypting: %w", eerr)
+					return
+				}
+				chunk = eb
+			}
 			/* Roll a query. */
 			qb.Reset()
 			qb.WriteString(strconv.FormatUint(qn, 36))
 			qb.WriteRune('.')
-			qb.WriteString(enc(buf[:n]))
+			qb.WriteString(enc(chunk))
 			/* Send it off. */
 			if _, serr := c.query(qb.String()); nil != serr {
 				done <- fmt.Errorf("send: %w", serr)
 				return
 			}
-			/* Note how many bytes we sent. */
-			atomic.AddUint64(&c.fwd, uint64(n))
 			qn++
 		}
 		if nil != rerr {
 			done <- fmt.Errorf("read: %w", rerr)
+			return
 		}
 	}
 }
 
-/* proxyBack proxies from DNS to stdout.  It is unsafe to call proxyBack from
+/* proxyBack proxies from DNS to c.conn.  It is unsafe to call proxyBack from
 multiple goroutines. */
 func (c *client) proxyBack(done chan<- error) {
 	var (
@@ -154,12 +272,11 @@ func (c *client) proxyBack(done chan<- error) {
 		qn++
 		/* We got some. Don't sleep before next poll. */
 		if 0 != len(b) {
-			/* Try to proxy to stdout. */
-			if _, werr := os.Stdout.Write(b); nil != werr {
+			/* Try to proxy to c.conn. */
+			if _, werr := c.conn.Write(b); nil != werr {
 				done <- fmt.Errorf("write: %w", werr)
 				return
 			}
-			atomic.AddUint64(&c.rev, uint64(len(b)))
 			c.pollCur = pollMin
 			continue
 		}
@@ -188,33 +305,98 @@ func (c *client) poll(qn uint64, b *bytes.Buffer) ([]byte, error) {
 	if nil != err {
 		return nil, fmt.Errorf("recv: %w", err)
 	}
-	return d, nil
+	if 0 == len(d) || nil == c.revKey {
+		return d, nil
+	}
+	pb, err := open(c.revKey, qn, true, d)
+	if nil != err {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+	return pb, nil
 }
 
-// Client is the client side of DPC.  It proxies stdio via DNS queries for the
-// given domain and reports the number of bytes transferred.
-func Client(domain string, poll time.Duration) (fwd, rev uint64, err error) {
+// Options configures a Dial call, beyond the mandatory domain.
+type Options struct {
+	// Poll is the maximum poll interval (less jitter).  Defaults to
+	// defaultPoll if 0.
+	Poll time.Duration
+
+	// DoHUpstream, if set, is a DoH (RFC 8484) URL to which queries are
+	// POSTed instead of being made via the system resolver.
+	DoHUpstream string
+
+	// CryptKeyFile, if set, is a pinned server public key (hex-encoded)
+	// the handshake must match; this guards against an on-path DNS
+	// responder impersonating the real server.  Ignored if Insecure.
+	CryptKeyFile string
+
+	// Insecure disables the authentication/encryption layer entirely,
+	// for compatibility with older servers.
+	Insecure bool
+}
+
+// Dial performs the DPC handshake with the server for domain and returns a
+// net.Conn whose Read/Write proxy stdio-shaped data over DNS queries for
+// domain.  Closing the returned net.Conn, or cancelling ctx, stops proxying.
+//
+// Unless opts.Insecure is true, forward and reverse payloads are
+// authenticated and encrypted via an X25519/XChaCha20-Poly1305 handshake
+// (see crypto.go).
+func Dial(ctx context.Context, domain string, opts Options) (net.Conn, error) {
+	poll := opts.Poll
+	if 0 == poll {
+		poll = defaultPoll
+	}
+
 	/* Roll a client with a clean domain. */
-	c := client{
-		domain:  "." + strings.Trim(domain, "."),
-		pollMax: poll,
+	c := &client{
+		ctx:         ctx,
+		domain:      "." + strings.Trim(domain, "."),
+		pollMax:     poll,
+		dohUpstream: opts.DoHUpstream,
+		insecure:    opts.Insecure,
+		recType:     dnsmessage.TypeTXT,
+	}
+
+	/* Load the pinned server public key, if we have one. */
+	if !opts.Insecure && "" != opts.CryptKeyFile {
+		pub, err := loadPin(opts.CryptKeyFile)
+		if nil != err {
+			return nil, fmt.Errorf("loading pinned server key: %w", err)
+		}
+		c.pinnedServerPub = pub
 	}
 
 	/* Ask the server for a connection ID. */
 	if err := c.handshake(); nil != err {
-		return 0, 0, fmt.Errorf("handshake: %w", err)
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	/* See if we can use a higher-throughput RR type for the reverse
+	path. */
+	if "" == opts.DoHUpstream {
+		c.negotiateRecType()
 	}
 
-	/* Start proxying. */
+	/* Start proxying between a pipe and the DNS server; the remote end
+	of the pipe is what we hand back to the caller. */
+	local, remote := net.Pipe()
+	c.conn = local
+	/* Cancelling pctx makes proxyBack's queries fail, so it stops
+	polling once either side's done, too. */
+	pctx, cancel := context.WithCancel(ctx)
+	c.ctx = pctx
 	done := make(chan error, 2)
 	go c.proxyForward(done)
 	go c.proxyBack(done)
+	go func() {
+		select {
+		case <-done:
+		case <-pctx.Done():
+		}
+		cancel()
+		local.Close()
+	}()
 
-	/* Wait for one side to have an error. */
-	err = <-done
-	defer func() { <-done }() /* Don't leak. */
-	fwd = atomic.LoadUint64(&c.fwd)
-	rev = atomic.LoadUint64(&c.rev)
-
-	return
+	return remote, nil
 }
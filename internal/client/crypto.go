@@ -0,0 +1,88 @@
+package client
+
+/*
+ * crypto.go
+ * Authenticated encryption for tunnelled payloads
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* x25519PubLen is the length in bytes of an X25519 public key. */
+const x25519PubLen = 32
+
+/* b32enc encodes a client public key for inclusion in a new-connection
+query label. */
+var b32enc = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString
+
+/* deriveKeys derives the forward and reverse AEAD keys from an ECDH shared
+secret.  This must match server.deriveKeys exactly. */
+func deriveKeys(secret []byte) (fwdKey, revKey []byte) {
+	f := sha256.Sum256(append(append([]byte{}, secret...), "fwd"...))
+	r := sha256.Sum256(append(append([]byte{}, secret...), "rev"...))
+	return f[:], r[:]
+}
+
+/* nonceFor builds the XChaCha20-Poly1305 nonce for a per-direction counter.
+This must match server.nonceFor exactly. */
+func nonceFor(ctr uint64, reverse bool) []byte {
+	n := make([]byte, chacha20poly1305.NonceSizeX)
+	if reverse {
+		n[0] = 1
+	}
+	binary.BigEndian.PutUint64(n[len(n)-8:], ctr)
+	return n
+}
+
+/* seal encrypts and authenticates b under key, using ctr/reverse for the
+nonce. */
+func seal(key []byte, ctr uint64, reverse bool, b []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if nil != err {
+		return nil, fmt.Errorf("initializing AEAD: %w", err)
+	}
+	return aead.Seal(nil, nonceFor(ctr, reverse), b, nil), nil
+}
+
+/* open authenticates and decrypts b under key, the reverse of seal. */
+func open(key []byte, ctr uint64, reverse bool, b []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if nil != err {
+		return nil, fmt.Errorf("initializing AEAD: %w", err)
+	}
+	return aead.Open(nil, nonceFor(ctr, reverse), b, nil)
+}
+
+/* loadPin reads an expected, pinned server public key (hex-encoded) from
+keyFile, for verifying the server during the handshake. */
+func loadPin(keyFile string) (*ecdh.PublicKey, error) {
+	b, err := os.ReadFile(keyFile)
+	if nil != err {
+		return nil, fmt.Errorf("reading %s: %w", keyFile, err)
+	}
+	kb, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if nil != err {
+		return nil, fmt.Errorf("decoding key in %s: %w", keyFile, err)
+	}
+	return ecdh.X25519().NewPublicKey(kb)
+}
+
+/* genKeypair generates an ephemeral X25519 keypair for a single connection's
+handshake. */
+func genKeypair() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
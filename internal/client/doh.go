@@ -0,0 +1,107 @@
+package client
+
+/*
+ * doh.go
+ * DNS-over-HTTPS query transport
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* dohContentType is the content-type used for DoH requests and responses,
+per RFC 8484. */
+const dohContentType = "application/dns-message"
+
+/* dohHTTPClient is used for all DoH queries. */
+var dohHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+/* queryDoH makes a TXT query for sd+c.domain via DoH against c.dohUpstream
+and returns the TXT record, the same way queryTXT does. */
+func (c *client) queryDoH(sd string) ([]byte, error) {
+	name, err := dnsmessage.NewName(sd + c.domain + ".")
+	if nil != err {
+		return nil, fmt.Errorf("building name for %q: %w", sd, err)
+	}
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	qb, err := q.Pack()
+	if nil != err {
+		return nil, fmt.Errorf("packing query for %q: %w", sd, err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		c.ctx,
+		http.MethodPost,
+		c.dohUpstream,
+		bytes.NewReader(qb),
+	)
+	if nil != err {
+		return nil, fmt.Errorf("building DoH request: %w", err)
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	res, err := dohHTTPClient.Do(req)
+	if nil != err {
+		return nil, fmt.Errorf("DoH request for %q: %w", sd, err)
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf(
+			"DoH request for %q: status %s",
+			sd,
+			res.Status,
+		)
+	}
+	rb, err := io.ReadAll(res.Body)
+	if nil != err {
+		return nil, fmt.Errorf("reading DoH response for %q: %w", sd, err)
+	}
+
+	var a dnsmessage.Message
+	if err := a.Unpack(rb); nil != err {
+		return nil, fmt.Errorf("unpacking DoH response for %q: %w", sd, err)
+	}
+	if dnsmessage.RCodeNameError == a.RCode {
+		return nil, nil
+	}
+	if 0 == len(a.Answers) {
+		return nil, nil
+	}
+	txt, ok := a.Answers[0].Body.(*dnsmessage.TXTResource)
+	if !ok {
+		return nil, fmt.Errorf("non-TXT answer for %q", sd)
+	}
+	/* A record's strings are concatenated, as net.LookupTXT does. */
+	s := strings.Join(txt.TXT, "")
+	if 0 == len(s) {
+		return []byte{}, nil
+	}
+
+	b, err := dec(s)
+	if nil != err {
+		return nil, fmt.Errorf("decoding %q: %w", s, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,117 @@
+package client
+
+/*
+ * rrpack.go
+ * Alternate, higher-throughput reverse-path query types
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* probePayload is what the server echoes back for a "probe" reverse-path
+query, used by negotiateRecType to test whether a given RR type survives the
+path to the server intact. */
+var probePayload = []byte("DPCPROBE")
+
+/* cnameB32 decodes CNAME answer labels; it must match server.cnameB32. */
+var cnameB32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/* negotiateRecType tries, in order of preference, the RR types which can
+carry more than a plain TXT record's worth of reverse-path data per poll,
+and sets c.recType to the first that round-trips a probe successfully.
+Falls back to TypeTXT, which is always supported. */
+func (c *client) negotiateRecType() {
+	c.recType = dnsmessage.TypeTXT
+	for _, t := range []dnsmessage.Type{
+		dnsmessage.TypeAAAA,
+		dnsmessage.TypeCNAME,
+	} {
+		c.recType = t
+		b, err := c.query("probe")
+		if nil == err && bytes.Equal(b, probePayload) {
+			return
+		}
+	}
+	c.recType = dnsmessage.TypeTXT
+}
+
+/* queryAAAA makes an AAAA query for sd+c.domain and unpacks the synthetic
+addresses back into the reverse-path payload they carry.  The resolver
+doesn't preserve wire order across multiple AAAA answers (Go's resolver, like
+most, re-sorts them per RFC 6724 destination-address-selection rules), so
+each answer's first byte carries its index (see server.packAnswers) and
+queryAAAA reassembles by that index rather than by lookup order. */
+func (c *client) queryAAAA(sd string) ([]byte, error) {
+	ips, err := net.DefaultResolver.LookupIP(
+		c.ctx,
+		"ip6",
+		sd+c.domain,
+	)
+	if nil != err {
+		return nil, fmt.Errorf("querying AAAA for %q: %w", sd, err)
+	}
+	chunks := make(map[byte][]byte, len(ips))
+	for _, ip := range ips {
+		b := ip.To16()
+		if nil == b {
+			return nil, fmt.Errorf("non-IPv6 address in AAAA answer")
+		}
+		chunks[b[0]] = b[1:]
+	}
+	raw := make([]byte, 0, len(chunks)*15)
+	for i := 0; i < len(chunks); i++ {
+		chunk, ok := chunks[byte(i)]
+		if !ok {
+			return nil, fmt.Errorf("missing AAAA answer for index %d", i)
+		}
+		raw = append(raw, chunk...)
+	}
+	return unprefixLen(raw)
+}
+
+/* queryCNAME makes a CNAME query for sd+c.domain and unpacks the target's
+base32'd labels back into the reverse-path payload they carry. */
+func (c *client) queryCNAME(sd string) ([]byte, error) {
+	target, err := net.DefaultResolver.LookupCNAME(
+		c.ctx,
+		sd+c.domain,
+	)
+	if nil != err {
+		return nil, fmt.Errorf("querying CNAME for %q: %w", sd, err)
+	}
+	var raw []byte
+	for _, l := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		b, err := cnameB32.DecodeString(strings.ToUpper(l))
+		if nil != err {
+			return nil, fmt.Errorf("decoding CNAME label %q: %w", l, err)
+		}
+		raw = append(raw, b...)
+	}
+	return unprefixLen(raw)
+}
+
+/* unprefixLen strips and validates the length prefix packAnswers (server
+side) adds ahead of AAAA and CNAME payloads. */
+func unprefixLen(b []byte) ([]byte, error) {
+	const lenPrefixLen = 2
+	if len(b) < lenPrefixLen {
+		return nil, fmt.Errorf("short payload (%d bytes)", len(b))
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[lenPrefixLen:]
+	if n > len(b) {
+		return nil, fmt.Errorf("length prefix %d exceeds payload", n)
+	}
+	return b[:n], nil
+}
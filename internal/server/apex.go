@@ -0,0 +1,354 @@
+package server
+
+/*
+ * apex.go
+ * Authoritative answers for the zone apex
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	/* defaultApexTTL is used if ApexRecords.TTL is 0. */
+	defaultApexTTL = 5 * time.Minute
+
+	/* upstreamTimeout bounds how long we'll wait for a reply from
+	ApexRecords.UpstreamRecursor. */
+	upstreamTimeout = 5 * time.Second
+
+	/* edns0UDPSize is the UDP payload size we advertise in our own EDNS0
+	OPT record, and the most we'll assume a client can receive. */
+	edns0UDPSize = 4096
+)
+
+/* typeCAA and typeDNSKEY are RR types dnsmessage doesn't have constants for.
+Questions carry a bare uint16 Type regardless of whether dnsmessage knows
+about it, so these are fine to use for both questions and, via
+UnknownResource (see below), answers. */
+const (
+	typeCAA    dnsmessage.Type = 257
+	typeDNSKEY dnsmessage.Type = 48
+)
+
+// ApexRecords configures the records a Server answers authoritatively for
+// its own domain's apex (as opposed to tunnel subdomains).
+type ApexRecords struct {
+	// NS is this zone's nameserver hostnames, answered for NS queries.
+	NS []string
+
+	// A and AAAA are this zone's apex address records.
+	A    []net.IP
+	AAAA []net.IP
+
+	// CAAIssue, if set, is the sole issuer allowed by the apex's CAA
+	// record (RFC 8659); unset means no CAA record is answered.
+	CAAIssue string
+
+	// SOAEmail is the responsible-party email address in the SOA record,
+	// in DNS master-file form (e.g. "hostmaster.example.com.").
+	// Defaults to "hostmaster." + the domain if unset.
+	SOAEmail string
+
+	// TTL is the TTL used on the SOA record (as its MINIMUM field and its
+	// own header) and on the other apex records.  Defaults to
+	// defaultApexTTL if 0.
+	TTL time.Duration
+
+	// UpstreamRecursor, if set, is an "address:port" to which apex
+	// queries of types we don't otherwise answer are forwarded verbatim,
+	// so the domain can also resolve normally when delegated from a
+	// public zone.
+	UpstreamRecursor string
+}
+
+/* hasEDNS0 reports whether as, a message's Additionals, contains an EDNS0 OPT
+pseudo-record. */
+func hasEDNS0(as []dnsmessage.Resource) bool {
+	for _, a := range as {
+		if dnsmessage.TypeOPT == a.Header.Type {
+			return true
+		}
+	}
+	return false
+}
+
+/* addEDNS0 appends an OPT pseudo-record advertising edns0UDPSize to msg's
+Additionals, so large answers (synthesized tunnel payloads as well as apex
+records) aren't assumed truncated by resolvers enforcing the classic 512-byte
+limit. */
+func addEDNS0(msg *dnsmessage.Message) {
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(edns0UDPSize, dnsmessage.RCodeSuccess, false); nil != err {
+		log.Printf("Setting EDNS0 header: %s", err)
+		return
+	}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: h,
+		Body:   &dnsmessage.OPTResource{},
+	})
+}
+
+/* soaEmail returns the configured SOA responsible-party email, or a sensible
+default. */
+func (s *Server) soaEmail() string {
+	if "" != s.soaEmailOpt {
+		return s.soaEmailOpt
+	}
+	return "hostmaster" + s.domainName
+}
+
+/* soaResource builds this Server's SOA record for name. */
+func (s *Server) soaResource(name dnsmessage.Name) (dnsmessage.Resource, error) {
+	var ns dnsmessage.Name = name
+	if 0 != len(s.ns) {
+		n, err := dnsmessage.NewName(s.ns[0])
+		if nil != err {
+			return dnsmessage.Resource{}, fmt.Errorf(
+				"parsing NS hostname %q: %w",
+				s.ns[0],
+				err,
+			)
+		}
+		ns = n
+	}
+	mbox, err := dnsmessage.NewName(s.soaEmail())
+	if nil != err {
+		return dnsmessage.Resource{}, fmt.Errorf(
+			"parsing SOA email %q: %w",
+			s.soaEmail(),
+			err,
+		)
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   s.apexTTL,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  s.soaSerial,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  604800,
+			MinTTL:  s.apexTTL,
+		},
+	}, nil
+}
+
+/* nsResources builds this Server's NS records for name. */
+func (s *Server) nsResources(name dnsmessage.Name) ([]dnsmessage.Resource, error) {
+	ans := make([]dnsmessage.Resource, 0, len(s.ns))
+	for _, h := range s.ns {
+		n, err := dnsmessage.NewName(h)
+		if nil != err {
+			return nil, fmt.Errorf("parsing NS hostname %q: %w", h, err)
+		}
+		ans = append(ans, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeNS,
+				Class: dnsmessage.ClassINET,
+				TTL:   s.apexTTL,
+			},
+			Body: &dnsmessage.NSResource{NS: n},
+		})
+	}
+	return ans, nil
+}
+
+/* aResources builds this Server's A records for name. */
+func (s *Server) aResources(name dnsmessage.Name) []dnsmessage.Resource {
+	ans := make([]dnsmessage.Resource, 0, len(s.a))
+	for _, ip := range s.a {
+		var a [4]byte
+		copy(a[:], ip.To4())
+		ans = append(ans, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   s.apexTTL,
+			},
+			Body: &dnsmessage.AResource{A: a},
+		})
+	}
+	return ans
+}
+
+/* aaaaResources builds this Server's AAAA records for name. */
+func (s *Server) aaaaResources(name dnsmessage.Name) []dnsmessage.Resource {
+	ans := make([]dnsmessage.Resource, 0, len(s.aaaa))
+	for _, ip := range s.aaaa {
+		var a [16]byte
+		copy(a[:], ip.To16())
+		ans = append(ans, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeAAAA,
+				Class: dnsmessage.ClassINET,
+				TTL:   s.apexTTL,
+			},
+			Body: &dnsmessage.AAAAResource{AAAA: a},
+		})
+	}
+	return ans
+}
+
+/* caaResource builds this Server's CAA record for name, or returns nil if no
+issuer's configured.  dnsmessage has no native CAA type, so the record's
+built by hand (RFC 8659) and wrapped in an UnknownResource, which is the only
+ResourceBody implementation usable from outside the dnsmessage package. */
+func (s *Server) caaResource(name dnsmessage.Name) *dnsmessage.Resource {
+	if "" == s.caaIssue {
+		return nil
+	}
+	rdata := make([]byte, 0, 2+len(s.caaIssue))
+	rdata = append(rdata, 0)                  /* Flags: not critical. */
+	rdata = append(rdata, byte(len("issue"))) /* Tag length. */
+	rdata = append(rdata, "issue"...)
+	rdata = append(rdata, s.caaIssue...)
+	return &dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Class: dnsmessage.ClassINET,
+			TTL:   s.apexTTL,
+		},
+		Body: &dnsmessage.UnknownResource{Type: typeCAA, Data: rdata},
+	}
+}
+
+/* answerApex builds an authoritative response for q, a question for the zone
+apex itself (as opposed to a tunnel subdomain).  Queries of types we don't
+answer ourselves are forwarded verbatim to s.upstreamRecursor, if configured;
+otherwise unanswerable types get NODATA, same as an empty answer set. */
+func (s *Server) answerApex(msg dnsmessage.Message, q dnsmessage.Question, raw []byte, hasEDNS bool) []byte {
+	var (
+		ans            []dnsmessage.Resource
+		err            error
+		upstreamFailed bool
+	)
+	switch q.Type {
+	case dnsmessage.TypeSOA:
+		var r dnsmessage.Resource
+		r, err = s.soaResource(q.Name)
+		if nil == err {
+			ans = []dnsmessage.Resource{r}
+		}
+	case dnsmessage.TypeNS:
+		ans, err = s.nsResources(q.Name)
+	case dnsmessage.TypeA:
+		ans = s.aResources(q.Name)
+	case dnsmessage.TypeAAAA:
+		ans = s.aaaaResources(q.Name)
+	case typeCAA:
+		if r := s.caaResource(q.Name); nil != r {
+			ans = []dnsmessage.Resource{*r}
+		}
+	case typeDNSKEY:
+		/* We don't sign the zone, so there's nothing to return; the
+		NODATA-with-SOA path, below, is the correct answer. */
+	default:
+		if "" != s.upstreamRecursor {
+			if fb, ferr := s.forwardUpstream(raw); nil == ferr {
+				return fb
+			} else {
+				log.Printf(
+					"[%s] Forwarding %s query to %s: %s",
+					q.Name,
+					q.Type,
+					s.upstreamRecursor,
+					ferr,
+				)
+				upstreamFailed = true
+			}
+		}
+	}
+	switch {
+	case nil != err:
+		log.Printf("[%s] Building %s answer: %s", q.Name, q.Type, err)
+		msg.RCode = dnsmessage.RCodeServerFailure
+	case upstreamFailed:
+		/* The upstream recursor's the only thing that can answer
+		this query type, and it's unreachable right now; that's a
+		transient failure, not an authoritative NODATA, so don't let
+		it get negative-cached. */
+		msg.RCode = dnsmessage.RCodeServerFailure
+	default:
+		msg.RCode = dnsmessage.RCodeSuccess
+		msg.Answers = ans
+		if 0 == len(ans) {
+			/* NODATA: no error, but an SOA in the authority
+			section lets recursive resolvers negative-cache
+			this. */
+			soa, serr := s.soaResource(q.Name)
+			if nil != serr {
+				log.Printf(
+					"[%s] Building authority SOA: %s",
+					q.Name,
+					serr,
+				)
+			} else {
+				msg.Authorities = []dnsmessage.Resource{soa}
+			}
+		}
+	}
+	if hasEDNS {
+		addEDNS0(&msg)
+	}
+	b, perr := msg.Pack()
+	if nil != perr {
+		log.Printf("[%s] Packing apex response: %s", q.Name, perr)
+		return nil
+	}
+	return b
+}
+
+/* forwardUpstream sends raw, a raw wire-format query, to s.upstreamRecursor
+over UDP and returns its raw wire-format response, unmodified, so the
+upstream's answer (including its own EDNS0 handling) is preserved exactly. */
+func (s *Server) forwardUpstream(raw []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", s.upstreamRecursor, upstreamTimeout)
+	if nil != err {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err := conn.Write(raw); nil != err {
+		return nil, fmt.Errorf("sending query: %w", err)
+	}
+	b := make([]byte, bufLen)
+	n, err := conn.Read(b)
+	if nil != err {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	return b[:n], nil
+}
+
+/* parseApexOptions turns an ApexRecords into Server fields, filling in
+defaults. */
+func (s *Server) parseApexOptions(ar ApexRecords) {
+	s.ns = append([]string(nil), ar.NS...)
+	s.a = append([]net.IP(nil), ar.A...)
+	s.aaaa = append([]net.IP(nil), ar.AAAA...)
+	s.caaIssue = strings.TrimSuffix(ar.CAAIssue, ".")
+	s.soaEmailOpt = ar.SOAEmail
+	s.upstreamRecursor = ar.UpstreamRecursor
+	s.apexTTL = uint32(ar.TTL / time.Second)
+	if 0 == s.apexTTL {
+		s.apexTTL = uint32(defaultApexTTL / time.Second)
+	}
+	s.soaSerial = uint32(time.Now().Unix())
+}
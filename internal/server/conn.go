@@ -5,24 +5,21 @@ package server
  * Manage connections
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220323
+ * Last Modified 20260730
  */
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	conns      = make(map[string]*conn)
-	connNextID = uint64(time.Now().UnixNano())
-	connsL     sync.RWMutex
-)
-
-/* conn is a connection between a DNS client and its proxied TCP connection. */
+/* conn is a connection between a DNS client and its net.Conn, as returned
+from Server.Accept. */
 type conn struct {
 	start time.Time /* Read-only */
 	last  time.Time /* Last activity */
@@ -34,11 +31,34 @@ type conn struct {
 	nextRev  uint64
 	nextRevL sync.Mutex
 
-	c      net.Conn /* Upstream connection. */
-	closed bool
-	cL     sync.Mutex
+	/* fwdKey and revKey, if set, are the per-direction AEAD keys derived
+	from this conn's ECDH handshake (see crypto.go).  They're nil in
+	-insecure mode, in which case payloads are sent in the clear, as
+	before. */
+	fwdKey []byte
+	revKey []byte
+
+	c net.Conn /* Local end of the pipe; Accept returns the remote end. */
 }
 
+/* dpcAddr is the net.Addr of an accepted conn; its String is the
+connection's ID, for logging. */
+type dpcAddr string
+
+func (a dpcAddr) Network() string { return "dpc" }
+func (a dpcAddr) String() string  { return string(a) }
+
+/* acceptedConn wraps the remote end of a conn's pipe, so its LocalAddr and
+RemoteAddr report the connection's ID rather than the pipe's placeholder
+addresses. */
+type acceptedConn struct {
+	net.Conn
+	id string
+}
+
+func (c *acceptedConn) LocalAddr() net.Addr  { return dpcAddr(c.id) }
+func (c *acceptedConn) RemoteAddr() net.Addr { return dpcAddr(c.id) }
+
 /* updateLast updates c.last. */
 func (c *conn) updateLast() {
 	c.timeL.Lock()
@@ -46,92 +66,93 @@ func (c *conn) updateLast() {
 	c.last = time.Now()
 }
 
-/* newConn makes a new conn and returns its ID. */
-func newConn() (string, error) {
-	c := new(conn)
-	var err error
-
-	/* Connect upstream */
-	c.c, err = net.Dial("tcp", upstreamAddr)
-	if nil != err {
-		return "", err
+/* newConn makes a new conn, with the given per-direction AEAD keys (nil in
+-insecure mode), hands the caller-facing end of its pipe to whoever's
+blocked in s.Accept, and returns the conn's ID. */
+func (s *Server) newConn(fwdKey, revKey []byte) (string, error) {
+	local, remote := net.Pipe()
+	c := &conn{
+		c:      local,
+		start:  time.Now(),
+		fwdKey: fwdKey,
+		revKey: revKey,
 	}
-	c.start = time.Now()
 
 	/* Give it an ID. */
-	connsL.Lock()
-	defer connsL.Unlock()
-	id := strconv.FormatUint(connNextID, 36)
-	connNextID++
-
-	/* Save for future use. */
-	conns[id] = c
+	s.connsL.Lock()
+	id := strconv.FormatUint(s.connNextID, 36)
+	s.connNextID++
+	s.conns[id] = c
+	s.connsL.Unlock()
+
+	/* Hand it to whoever's Accepting. */
+	select {
+	case s.acceptCh <- &acceptedConn{Conn: remote, id: id}:
+	case <-s.closeCh:
+		s.deleteConn(id)
+		return "", fmt.Errorf("listener closed")
+	}
 
-	log.Printf(
-		"[%s] New connection: %s->%s",
-		id,
-		c.c.LocalAddr(),
-		c.c.RemoteAddr(),
-	)
+	log.Printf("[%s] New connection", id)
 
 	return id, nil
 }
 
 /* getConn gets a conn by ID. */
-func getConn(id string) (*conn, bool) {
-	connsL.RLock()
-	defer connsL.RUnlock()
-	c, ok := conns[id]
+func (s *Server) getConn(id string) (*conn, bool) {
+	s.connsL.RLock()
+	defer s.connsL.RUnlock()
+	c, ok := s.conns[id]
 	return c, ok
 }
 
 /* deleteConn tries to delete (and close) the conn with the given id.  If the
 conn has already been deleted, deleteConn is a no-op. */
-func deleteConn(id string) {
+func (s *Server) deleteConn(id string) {
 	/* Get hold of the conn in question. */
-	connsL.Lock()
-	c, ok := conns[id]
+	s.connsL.Lock()
+	c, ok := s.conns[id]
 	/* If we got it, remove it before anybody else can get it. */
 	if ok {
-		delete(conns, id)
+		delete(s.conns, id)
 	}
-	defer connsL.Unlock()
+	s.connsL.Unlock()
 
 	/* If we don't have it, nothing else to do. */
 	if !ok {
 		return
 	}
 
-	/* Close the underlying connection. */
+	/* Close the underlying pipe. */
 	go closeConn(id, c)
 }
 
 /* pruneConns prunes the conns which haven't had any activity for a while. */
-func pruneConns(interval time.Duration) {
+func (s *Server) pruneConns(interval time.Duration) {
 	last := time.Now() /* Last sweep time. */
 	for {
 		time.Sleep(interval)
-		pruneConnsSince(last)
+		s.pruneConnsSince(last)
 		last = time.Now()
 	}
 }
 
 /* pruneConnsSince makes one sweep through the conns and closes the ones which
 haven't been updated since the last sweep. */
-func pruneConnsSince(last time.Time) {
-	connsL.Lock()
-	defer connsL.Unlock()
-	for id, c := range conns {
+func (s *Server) pruneConnsSince(last time.Time) {
+	s.connsL.Lock()
+	defer s.connsL.Unlock()
+	for id, c := range s.conns {
 		if c.last.Before(last) {
 			log.Printf("[%s] DNS timeout", id)
-			delete(conns, id)
+			delete(s.conns, id)
+			atomic.AddUint64(&s.metrics.prunedConns, 1)
 			go closeConn(id, c)
 		}
 	}
 }
 
-/* closeConn closes the given conn.  The ID is used for logging.  If wg is
-not nil, its Done method will be called on return. */
+/* closeConn closes the given conn's pipe.  The ID is used for logging. */
 func closeConn(id string, c *conn) {
 	if err := c.c.Close(); nil != err {
 		log.Printf("[%s] Closing connection: %s", id, err)
@@ -0,0 +1,107 @@
+package server
+
+/*
+ * crypto.go
+ * Authenticated encryption for tunnelled payloads
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// initCrypto sets up the Server's static keypair, loading it from keyFile if
+// given or generating (and logging) an ephemeral one otherwise.  If insec is
+// true, the encryption layer is disabled entirely and initCrypto only sets
+// s.insecure.
+func (s *Server) initCrypto(keyFile string, insec bool) error {
+	s.insecure = insec
+	if s.insecure {
+		return nil
+	}
+
+	curve := ecdh.X25519()
+	if "" == keyFile {
+		k, err := curve.GenerateKey(rand.Reader)
+		if nil != err {
+			return fmt.Errorf("generating ephemeral keypair: %w", err)
+		}
+		s.serverKey = k
+		log.Printf(
+			"No -crypt-key given; generated an ephemeral keypair. "+
+				"Pin this on clients with -crypt-key: %s",
+			hex.EncodeToString(k.PublicKey().Bytes()),
+		)
+		return nil
+	}
+
+	b, err := os.ReadFile(keyFile)
+	if nil != err {
+		return fmt.Errorf("reading %s: %w", keyFile, err)
+	}
+	kb, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if nil != err {
+		return fmt.Errorf("decoding key in %s: %w", keyFile, err)
+	}
+	k, err := curve.NewPrivateKey(kb)
+	if nil != err {
+		return fmt.Errorf("parsing key in %s: %w", keyFile, err)
+	}
+	s.serverKey = k
+
+	return nil
+}
+
+/* deriveKeys derives the forward and reverse AEAD keys from an ECDH shared
+secret.  The direction suffix gives simple key separation, so a compromise
+of one direction's key doesn't affect the other. */
+func deriveKeys(secret []byte) (fwdKey, revKey []byte) {
+	f := sha256.Sum256(append(append([]byte{}, secret...), "fwd"...))
+	r := sha256.Sum256(append(append([]byte{}, secret...), "rev"...))
+	return f[:], r[:]
+}
+
+/* nonceFor builds the XChaCha20-Poly1305 nonce for a per-direction counter.
+The counter's already a monotonically-increasing, per-connection,
+per-direction value (see nextFwd/nextRev in conn.go), which doubles as
+replay protection, so it's reused here rather than keeping a separate
+nonce. */
+func nonceFor(ctr uint64, reverse bool) []byte {
+	n := make([]byte, chacha20poly1305.NonceSizeX)
+	if reverse {
+		n[0] = 1
+	}
+	binary.BigEndian.PutUint64(n[len(n)-8:], ctr)
+	return n
+}
+
+/* seal encrypts and authenticates b under key, using ctr/reverse for the
+nonce (see nonceFor). */
+func seal(key []byte, ctr uint64, reverse bool, b []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if nil != err {
+		return nil, fmt.Errorf("initializing AEAD: %w", err)
+	}
+	return aead.Seal(nil, nonceFor(ctr, reverse), b, nil), nil
+}
+
+/* open authenticates and decrypts b under key, the reverse of seal. */
+func open(key []byte, ctr uint64, reverse bool, b []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if nil != err {
+		return nil, fmt.Errorf("initializing AEAD: %w", err)
+	}
+	return aead.Open(nil, nonceFor(ctr, reverse), b, nil)
+}
@@ -0,0 +1,111 @@
+package server
+
+/*
+ * doh.go
+ * DNS-over-HTTPS listener
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	/* dohPath is the path on which DoH queries are served. */
+	dohPath = "/dns-query"
+
+	/* dohContentType is the content-type used for DoH requests and
+	responses, per RFC 8484. */
+	dohContentType = "application/dns-message"
+
+	/* dohMaxBodyLen is the largest DoH POST body we'll read. */
+	dohMaxBodyLen = 65535
+)
+
+/* dohEnc is the base64url encoding used for the GET ?dns= parameter. */
+var dohEnc = base64.RawURLEncoding
+
+/* httpAddr lets an HTTP client's remote address be logged alongside the
+UDP listener's net.Addrs. */
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+/* listenDoH serves DoH (RFC 8484) queries for s's domain, on srv (whose Addr
+is already set by the caller; its Handler is set here).  If cert and key are
+both set, they're used for TLS; otherwise a certificate is obtained
+automatically via autocert for s's domain.  The caller keeps srv so it can
+later be closed (see Server.Close). */
+func (s *Server) listenDoH(srv *http.Server, cert, key string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, s.handleDoH)
+	srv.Handler = mux
+
+	if "" != cert && "" != key {
+		log.Printf("Listening for DoH on %s (cert %s)", srv.Addr, cert)
+		return srv.ListenAndServeTLS(cert, key)
+	}
+
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(
+			strings.Trim(s.domainName, "."),
+		),
+	}
+	srv.TLSConfig = m.TLSConfig()
+	log.Printf("Listening for DoH on %s (autocert)", srv.Addr)
+	return srv.ListenAndServeTLS("", "")
+}
+
+/* handleDoH handles a single DoH request per RFC 8484, decoding it into a
+wire-format query and dispatching it via s.processQuery just as the UDP
+listener does. */
+func (s *Server) handleDoH(w http.ResponseWriter, r *http.Request) {
+	var (
+		b   []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodPost:
+		if dohContentType != r.Header.Get("Content-Type") {
+			http.Error(
+				w,
+				"unsupported content-type",
+				http.StatusUnsupportedMediaType,
+			)
+			return
+		}
+		b, err = io.ReadAll(io.LimitReader(r.Body, dohMaxBodyLen))
+	case http.MethodGet:
+		q := r.URL.Query().Get("dns")
+		if "" == q {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		b, err = dohEnc.DecodeString(q)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if nil != err {
+		http.Error(w, "malformed query", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.processQuery(httpAddr(r.RemoteAddr), b)
+	if nil == resp {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(resp)
+}
@@ -5,7 +5,7 @@ package server
  * Handle forward transmission requests
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220323
+ * Last Modified 20260730
  */
 
 import (
@@ -13,13 +13,14 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 /* dec decodes base32'd data. */
 var dec = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString
 
 /* handleForward handles requests to send data upstream. */
-func handleForward(ctr, payload, id string) ([]byte, error) {
+func (s *Server) handleForward(ctr, payload, id string) ([]byte, error) {
 	/* Make sure the counter is a number. */
 	cn, err := strconv.ParseUint(ctr, 36, 64)
 	if nil != err {
@@ -33,7 +34,7 @@ func handleForward(ctr, payload, id string) ([]byte, error) {
 	}
 
 	/* Get the conn. */
-	c, ok := getConn(id)
+	c, ok := s.getConn(id)
 	if !ok {
 		return nil, fmt.Errorf("unknown ID")
 	}
@@ -44,15 +45,27 @@ func handleForward(ctr, payload, id string) ([]byte, error) {
 	if cn != c.nextFwd {
 		return nil, nil
 	}
+
+	/* If this conn's encrypted, decrypt and authenticate before we do
+	anything else with it. */
+	if nil != c.fwdKey {
+		pb, err := open(c.fwdKey, cn, false, b)
+		if nil != err {
+			s.deleteConn(id)
+			return nil, fmt.Errorf("decrypting payload: %w", err)
+		}
+		b = pb
+	}
 	c.nextFwd++
 
 	/* Send the data upstream. */
 	c.updateLast()
 	if _, err := c.c.Write(b); nil != err {
-		deleteConn(id)
+		s.deleteConn(id)
 		return nil, fmt.Errorf("sending to network: %w", err)
 	}
 	c.updateLast()
+	atomic.AddUint64(&s.metrics.bytesFwd, uint64(len(b)))
 
 	return []byte{}, nil
 }
@@ -0,0 +1,76 @@
+package server
+
+/*
+ * metrics.go
+ * Prometheus metrics endpoint
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+/* metrics holds a Server's running counters.  Fields are only ever touched
+via the sync/atomic package, so metrics itself needs no lock. */
+type metrics struct {
+	cacheHits   uint64
+	cacheMisses uint64
+	bytesFwd    uint64
+	bytesRev    uint64
+	prunedConns uint64
+	rateLimited uint64
+}
+
+/* listenMetrics serves a Prometheus text-format /metrics endpoint on srv
+(whose Addr is already set by the caller; its Handler is set here).  The
+caller keeps srv so it can later be closed (see Server.Close). */
+func (s *Server) listenMetrics(srv *http.Server) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	srv.Handler = mux
+	log.Printf("Listening for metrics on %s", srv.Addr)
+	return srv.ListenAndServe()
+}
+
+/* handleMetrics writes s's current counters in Prometheus text exposition
+format. */
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.connsL.RLock()
+	conns := len(s.conns)
+	s.connsL.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP dpc_connections Live client connections.\n")
+	fmt.Fprintf(w, "# TYPE dpc_connections gauge\n")
+	fmt.Fprintf(w, "dpc_connections %d\n", conns)
+
+	fmt.Fprintf(w, "# HELP dpc_cache_hits_total Answer cache hits.\n")
+	fmt.Fprintf(w, "# TYPE dpc_cache_hits_total counter\n")
+	fmt.Fprintf(w, "dpc_cache_hits_total %d\n", atomic.LoadUint64(&s.metrics.cacheHits))
+
+	fmt.Fprintf(w, "# HELP dpc_cache_misses_total Answer cache misses.\n")
+	fmt.Fprintf(w, "# TYPE dpc_cache_misses_total counter\n")
+	fmt.Fprintf(w, "dpc_cache_misses_total %d\n", atomic.LoadUint64(&s.metrics.cacheMisses))
+
+	fmt.Fprintf(w, "# HELP dpc_bytes_forward_total Bytes proxied client to upstream.\n")
+	fmt.Fprintf(w, "# TYPE dpc_bytes_forward_total counter\n")
+	fmt.Fprintf(w, "dpc_bytes_forward_total %d\n", atomic.LoadUint64(&s.metrics.bytesFwd))
+
+	fmt.Fprintf(w, "# HELP dpc_bytes_reverse_total Bytes proxied upstream to client.\n")
+	fmt.Fprintf(w, "# TYPE dpc_bytes_reverse_total counter\n")
+	fmt.Fprintf(w, "dpc_bytes_reverse_total %d\n", atomic.LoadUint64(&s.metrics.bytesRev))
+
+	fmt.Fprintf(w, "# HELP dpc_pruned_connections_total Connections closed for inactivity.\n")
+	fmt.Fprintf(w, "# TYPE dpc_pruned_connections_total counter\n")
+	fmt.Fprintf(w, "dpc_pruned_connections_total %d\n", atomic.LoadUint64(&s.metrics.prunedConns))
+
+	fmt.Fprintf(w, "# HELP dpc_rate_limited_total Queries dropped for exceeding the per-client rate limit.\n")
+	fmt.Fprintf(w, "# TYPE dpc_rate_limited_total counter\n")
+	fmt.Fprintf(w, "dpc_rate_limited_total %d\n", atomic.LoadUint64(&s.metrics.rateLimited))
+}
@@ -5,15 +5,16 @@ package server
  * Handle new connection requests
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220323
+ * Last Modified 20260730
  */
 
 import (
+	"crypto/ecdh"
+	"encoding/base32"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
-
-	lru "github.com/hashicorp/golang-lru"
 )
 
 const (
@@ -26,25 +27,49 @@ const (
 	maxTSOff = 24 * time.Hour
 )
 
-/* seenTSCache attempts to prevent replays of queries for new connections. */
-var seenTSCache *lru.TwoQueueCache
+/* b32dec decodes the base32'd client public key sent with a new-connection
+request. */
+var b32dec = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString
 
-func init() {
-	var err error
-	seenTSCache, err = lru.New2Q(tsCacheSize)
-	if nil != err {
-		panic(fmt.Sprintf("making timestamp cache: %s", err))
+/* handleNewConn handles requests for new connections.  In -insecure mode, l
+is just a decimal Unix nanosecond timestamp, as in earlier versions of DPC.
+Otherwise, l is "<timestamp>-<clientpub>", with the timestamp in seconds and
+base36 and the client's X25519 public key base32'd; in this case the
+response is the server's X25519 public key followed by the connection ID,
+and forward/reverse payloads on this connection are authenticated and
+encrypted (see crypto.go). */
+func (s *Server) handleNewConn(l string) ([]byte, error) {
+	var (
+		when      time.Time
+		clientPub []byte
+	)
+	if s.insecure {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if nil != err {
+			return nil, fmt.Errorf("parsing timestamp: %w", err)
+		}
+		when = time.Unix(0, n)
+	} else {
+		parts := strings.SplitN(l, "-", 2)
+		if 2 != len(parts) {
+			return nil, fmt.Errorf("missing client public key")
+		}
+		n, err := strconv.ParseInt(parts[0], 36, 64)
+		if nil != err {
+			return nil, fmt.Errorf("parsing timestamp: %w", err)
+		}
+		when = time.Unix(n, 0)
+		clientPub, err = b32dec(strings.ToUpper(parts[1]))
+		if nil != err {
+			return nil, fmt.Errorf(
+				"decoding client public key: %w",
+				err,
+			)
+		}
 	}
-}
 
-/* handleNewConn handles requests for new connections. */
-func handleNewConn(l string) ([]byte, error) {
 	/* Make sure the timestamp is within a day or so. */
-	n, err := strconv.ParseInt(l, 10, 64)
-	if nil != err {
-		return nil, fmt.Errorf("parsing timestamp: %w", err)
-	}
-	diff := time.Until(time.Unix(0, n))
+	diff := time.Until(when)
 	if 0 > diff {
 		diff *= -1
 	}
@@ -57,15 +82,40 @@ func handleNewConn(l string) ([]byte, error) {
 	}
 
 	/* Make sure we've not seen this timestamp. */
-	if seenTSCache.Contains(l) {
+	if s.seenTSCache.Contains(l) {
 		return nil, nil
 	}
-	seenTSCache.Add(l, nil)
+	s.seenTSCache.Add(l, nil)
+
+	/* Work out this connection's keys, if we're not -insecure. */
+	var (
+		fwdKey, revKey []byte
+		ourPub         []byte
+	)
+	if !s.insecure {
+		curve := ecdh.X25519()
+		cpk, err := curve.NewPublicKey(clientPub)
+		if nil != err {
+			return nil, fmt.Errorf(
+				"parsing client public key: %w",
+				err,
+			)
+		}
+		secret, err := s.serverKey.ECDH(cpk)
+		if nil != err {
+			return nil, fmt.Errorf("computing shared secret: %w", err)
+		}
+		fwdKey, revKey = deriveKeys(secret)
+		ourPub = s.serverKey.PublicKey().Bytes()
+	}
 
-	/* Connect upstream. */
-	id, err := newConn()
+	/* Register the connection, handing its conn off to Accept. */
+	id, err := s.newConn(fwdKey, revKey)
 	if nil != err {
-		return nil, fmt.Errorf("connecting upstream: %w", err)
+		return nil, fmt.Errorf("registering connection: %w", err)
+	}
+	if s.insecure {
+		return []byte(id), nil
 	}
-	return []byte(id), nil
+	return append(ourPub, []byte(id)...), nil
 }
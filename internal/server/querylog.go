@@ -0,0 +1,214 @@
+package server
+
+/*
+ * querylog.go
+ * Structured, rotating query log
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QueryLogFormat selects a Server's query log's on-disk format.
+type QueryLogFormat int
+
+const (
+	// QueryLogTab writes one tab-separated line per query.  It's the
+	// default.
+	QueryLogTab QueryLogFormat = iota
+	// QueryLogJSON writes one JSON object per query (JSON-lines).
+	QueryLogJSON
+)
+
+/* defaultQueryLogMaxSize is used if Options.QueryLogMaxSize is 0. */
+const defaultQueryLogMaxSize = 100 * 1024 * 1024 /* 100MiB */
+
+/* queryLogEntry is one query log record. */
+type queryLogEntry struct {
+	Time       time.Time `json:"time"`
+	Addr       string    `json:"addr"`
+	ConnID     string    `json:"conn_id,omitempty"`
+	Kind       string    `json:"kind"`
+	Counter    uint64    `json:"counter,omitempty"`
+	PayloadLen int       `json:"payload_len"`
+	CacheHit   bool      `json:"cache_hit"`
+	Err        string    `json:"err,omitempty"`
+}
+
+/* queryLog writes queryLogEntries to path, rotating by renaming the current
+file aside once it grows past maxSize. */
+type queryLog struct {
+	path    string
+	format  QueryLogFormat
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+/* openQueryLog opens (creating if need be) the query log at path. */
+func openQueryLog(path string, format QueryLogFormat, maxSize int64) (*queryLog, error) {
+	if 0 == maxSize {
+		maxSize = defaultQueryLogMaxSize
+	}
+	ql := &queryLog{path: path, format: format, maxSize: maxSize}
+	if err := ql.open(); nil != err {
+		return nil, err
+	}
+	return ql, nil
+}
+
+/* open (re)opens ql.path for appending.  It must be called with ql.mu held,
+except from openQueryLog, before ql's shared with any other goroutine. */
+func (ql *queryLog) open() error {
+	f, err := os.OpenFile(
+		ql.path,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0600,
+	)
+	if nil != err {
+		return fmt.Errorf("opening %s: %w", ql.path, err)
+	}
+	fi, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return fmt.Errorf("stat'ing %s: %w", ql.path, err)
+	}
+	ql.f = f
+	ql.size = fi.Size()
+	return nil
+}
+
+/* log writes e to ql, rotating first if e would push the file past
+ql.maxSize. */
+func (ql *queryLog) log(e queryLogEntry) {
+	b, err := ql.marshal(e)
+	if nil != err {
+		log.Printf("Marshalling query log entry: %s", err)
+		return
+	}
+
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	if nil != ql.f && ql.size+int64(len(b)) > ql.maxSize {
+		if err := ql.rotate(); nil != err {
+			log.Printf("Rotating query log: %s", err)
+		}
+	}
+	if nil == ql.f { /* Rotate failed to reopen. */
+		return
+	}
+	n, err := ql.f.Write(b)
+	ql.size += int64(n)
+	if nil != err {
+		log.Printf("Writing query log entry: %s", err)
+	}
+}
+
+/* marshal renders e per ql.format. */
+func (ql *queryLog) marshal(e queryLogEntry) ([]byte, error) {
+	switch ql.format {
+	case QueryLogJSON:
+		b, err := json.Marshal(e)
+		if nil != err {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	default: /* QueryLogTab. */
+		return []byte(fmt.Sprintf(
+			"%s\t%s\t%s\t%s\t%d\t%d\t%t\t%s\n",
+			e.Time.Format(time.RFC3339Nano),
+			e.Addr,
+			e.ConnID,
+			e.Kind,
+			e.Counter,
+			e.PayloadLen,
+			e.CacheHit,
+			e.Err,
+		)), nil
+	}
+}
+
+/* rotate renames the current log file aside and opens a new one in its
+place.  It must be called with ql.mu held. */
+func (ql *queryLog) rotate() error {
+	ql.f.Close()
+	ql.f = nil
+	rotated := ql.path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Rename(ql.path, rotated); nil != err {
+		return fmt.Errorf("renaming to %s: %w", rotated, err)
+	}
+	return ql.open()
+}
+
+/* queryKind names the tunnel operation a query's label count corresponds
+to, for the query log's Kind field. */
+func queryKind(nLabels int) string {
+	switch nLabels {
+	case 1:
+		return "new"
+	case 2:
+		return "reverse"
+	case 3:
+		return "forward"
+	default:
+		return "unknown"
+	}
+}
+
+/* logQuery writes a query log entry for a tunnel query, if s has a query log
+configured.  labels is the dot-split, domain-trimmed qname (see
+processQuery); err, if non-nil, is recorded in the entry. */
+func (s *Server) logQuery(addr net.Addr, labels []string, cacheHit bool, payloadLen int, err error) {
+	if nil == s.qlog {
+		return
+	}
+	e := queryLogEntry{
+		Time:       time.Now(),
+		Addr:       addr.String(),
+		Kind:       queryKind(len(labels)),
+		PayloadLen: payloadLen,
+		CacheHit:   cacheHit,
+	}
+	switch len(labels) {
+	case 2:
+		e.Counter, _ = strconv.ParseUint(labels[0], 36, 64)
+		e.ConnID = labels[1]
+	case 3:
+		e.Counter, _ = strconv.ParseUint(labels[0], 36, 64)
+		e.ConnID = labels[2]
+	}
+	if nil != err {
+		e.Err = err.Error()
+	}
+	s.qlog.log(e)
+}
+
+/* logApexQuery writes a query log entry for an apex query, if s has a query
+log configured. */
+func (s *Server) logApexQuery(addr net.Addr, payloadLen int, err error) {
+	if nil == s.qlog {
+		return
+	}
+	e := queryLogEntry{
+		Time:       time.Now(),
+		Addr:       addr.String(),
+		Kind:       "apex",
+		PayloadLen: payloadLen,
+	}
+	if nil != err {
+		e.Err = err.Error()
+	}
+	s.qlog.log(e)
+}
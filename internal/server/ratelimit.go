@@ -0,0 +1,74 @@
+package server
+
+/*
+ * ratelimit.go
+ * Per-client-IP query rate limiting
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/time/rate"
+)
+
+/* limiterCacheSize is the number of distinct client IPs whose token buckets
+we remember at once; this server's a juicy target for query-flood abuse
+(every query triggers a TCP read/write against caddr), so an LRU bound keeps
+an attacker rotating source IPs from growing this without bound. */
+const limiterCacheSize = 1 << 16
+
+/* initRateLimit sets up s's per-client-IP rate limiter.  qps<=0 disables
+rate limiting entirely (the default). */
+func (s *Server) initRateLimit(qps float64) error {
+	s.qps = qps
+	if 0 >= qps {
+		return nil
+	}
+	c, err := lru.New(limiterCacheSize)
+	if nil != err {
+		return fmt.Errorf("making rate limiter cache: %w", err)
+	}
+	s.limiters = c
+	return nil
+}
+
+/* allowQuery reports whether a query from addr is within s's configured
+per-client-IP rate limit.  It always returns true if rate limiting is
+disabled. */
+func (s *Server) allowQuery(addr net.Addr) bool {
+	if nil == s.limiters {
+		return true
+	}
+	ip := clientIP(addr)
+	lim, ok := s.limiters.Get(ip)
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(s.qps), int(math.Ceil(s.qps)))
+		s.limiters.Add(ip, lim)
+	}
+	allowed := lim.(*rate.Limiter).Allow()
+	if !allowed {
+		atomic.AddUint64(&s.metrics.rateLimited, 1)
+	}
+	return allowed
+}
+
+/* clientIP returns the bare IP address in addr, for use as a rate-limiter
+key; addr is usually a *net.UDPAddr (the UDP listener) or an httpAddr (the
+DoH listener, whose string is "host:port"). */
+func clientIP(addr net.Addr) string {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return ua.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		return addr.String()
+	}
+	return host
+}
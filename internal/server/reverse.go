@@ -5,39 +5,55 @@ package server
  * Handle reverse transmission requests
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220324
+ * Last Modified 20260730
  */
 
 import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const (
-	/* maxTXTLen is the maximum number of payload bytes which we'll send
-	in a TXT record. */
-	maxTXTLen = 189
 	/* readWait is the maximum amount of time to wait for a read from the
 	TCP connection. */
 	readWait = 10 * time.Millisecond
 )
 
-/* handleReverse handles requests to send data back to the client. */
-func handleReverse(ctr, id string) ([]byte, error) {
+/* probeCtr is the sentinel counter value clients use to test whether an RR
+type survives the path to the server intact (see rrpack.go and
+client.negotiateRecType); it's not a real forward/reverse counter, so it
+doesn't touch a conn's sequencing state. */
+const probeCtr = "probe"
+
+/* handleReverse handles requests to send data back to the client.  maxLen is
+the most raw bytes which may be returned, including any encryption overhead
+(which is taken out of the read size); it's derived from the RR type the
+client asked for (see rrpack.go). */
+func (s *Server) handleReverse(ctr, id string, maxLen int) ([]byte, error) {
+	/* Get the conn; even probes need a live connection. */
+	c, ok := s.getConn(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown ID")
+	}
+
+	/* A probe just echoes a known payload, to let the client test an RR
+	type without disturbing the real forward/reverse sequencing. */
+	if probeCtr == ctr {
+		c.updateLast()
+		return probePayload, nil
+	}
+
 	/* Make sure the counter is a number. */
 	cn, err := strconv.ParseUint(ctr, 36, 64)
 	if nil != err {
 		return nil, fmt.Errorf("unable to parse counter: %w", err)
 	}
 
-	/* Get the conn. */
-	c, ok := getConn(id)
-	if !ok {
-		return nil, fmt.Errorf("unknown ID")
-	}
-
 	/* Make sure we're at the right ID. */
 	c.nextRevL.Lock()
 	defer c.nextRevL.Unlock()
@@ -46,10 +62,15 @@ func handleReverse(ctr, id string) ([]byte, error) {
 	}
 	c.nextRev++
 
-	/* Try to read from upstream. */
-	buf := make([]byte, maxTXTLen)
+	/* Try to read from upstream.  If we're encrypting, leave room for
+	the AEAD's tag. */
+	bl := maxLen
+	if nil != c.revKey {
+		bl -= chacha20poly1305.Overhead
+	}
+	buf := make([]byte, bl)
 	if err := c.c.SetReadDeadline(time.Now().Add(readWait)); nil != err {
-		deleteConn(id)
+		s.deleteConn(id)
 		return nil, fmt.Errorf(
 			"setting network read deadline: %w",
 			err,
@@ -59,7 +80,16 @@ func handleReverse(ctr, id string) ([]byte, error) {
 	n, err := c.c.Read(buf)
 	c.updateLast()
 	if 0 != n { /* Read something */
-		return buf[:n], nil
+		atomic.AddUint64(&s.metrics.bytesRev, uint64(n))
+		if nil == c.revKey {
+			return buf[:n], nil
+		}
+		eb, serr := seal(c.revKey, cn, true, buf[:n])
+		if nil != serr {
+			s.deleteConn(id)
+			return nil, fmt.Errorf("encrypting payload: %w", serr)
+		}
+		return eb, nil
 	}
 	if nil != err { /* Read nothing, and an error. */
 		var te interface{ Timeout() bool }
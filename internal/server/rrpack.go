@@ -0,0 +1,173 @@
+package server
+
+/*
+ * rrpack.go
+ * Pack reverse-path payloads into different RR types
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	/* maxTXTStrings is the most TXT strings we'll put in one TXT
+	answer. */
+	maxTXTStrings = 8
+	/* maxTXTStringLen is the length limit of a single TXT
+	character-string. */
+	maxTXTStringLen = 255
+
+	/* maxAAAARecords is the most synthetic AAAA answers we'll return for
+	a single reverse poll. */
+	maxAAAARecords = 20
+	/* aaaaDataLen is the number of payload bytes packed into each AAAA
+	answer; the first byte of the address carries that answer's index
+	(see packAnswers), since net.Resolver.LookupIP re-sorts multi-answer
+	AAAA responses per RFC 6724 and can't be relied on to preserve wire
+	order. */
+	aaaaDataLen = 15
+
+	/* maxCNAMELabels is the most base32'd data labels we'll pack into a
+	single CNAME answer's target.  dnsmessage.Name's wire-format Data is
+	only 255 bytes, and each label costs cnameLabelLen+1 (a length byte
+	plus the label) of that, plus a trailing root byte, so this must
+	satisfy maxCNAMELabels*(cnameLabelLen+1)+1 <= 255; with
+	cnameLabelLen=63 that caps out at 3. */
+	maxCNAMELabels = 3
+	/* cnameLabelLen is the length of each base32'd CNAME data label. */
+	cnameLabelLen = 63
+
+	/* tunnelAnswerTTL is the TTL set on tunnel reverse-path answers.  It's
+	short, rather than 0, so legitimate caches collapse retransmits of the
+	same query; it's safe to cache at all because every poll's qname
+	(counter and/or connection ID) is unique, so a cached answer is never
+	served for a different query. */
+	tunnelAnswerTTL = 5
+)
+
+/* cnameB32 is the base32 alphabet used for CNAME answer labels; it must only
+use characters valid in a DNS label. */
+var cnameB32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/* probePayload is echoed back for a probe reverse-path query (see
+reverse.go); it must match client.probePayload. */
+var probePayload = []byte("DPCPROBE")
+
+/* b64enc is used to pack TXT-answer payloads. */
+var b64enc = base64.RawStdEncoding.EncodeToString
+
+/* prefixLen prepends payload with its own length, for the RR types (AAAA,
+CNAME) whose fixed-size chunks can't otherwise distinguish real data from
+trailing padding. */
+func prefixLen(payload []byte) []byte {
+	b := make([]byte, lenPrefixLen+len(payload))
+	binary.BigEndian.PutUint16(b, uint16(len(payload)))
+	copy(b[lenPrefixLen:], payload)
+	return b
+}
+
+/* lenPrefixLen is the size of the length prefix packAnswers adds ahead of
+AAAA and CNAME payloads, so the client knows how many of the trailing
+fixed-size chunk's bytes are real data and how many are padding. */
+const lenPrefixLen = 2
+
+/* maxPayloadLen returns the most raw (unpacked) reverse-path payload bytes
+which can be packed into a single answer of type t.  Unrecognized types get
+the TXT budget, as that's the original, always-supported RR type. */
+func maxPayloadLen(t dnsmessage.Type) int {
+	switch t {
+	case dnsmessage.TypeAAAA:
+		return maxAAAARecords*aaaaDataLen - lenPrefixLen
+	case dnsmessage.TypeCNAME:
+		/* Each base32 label of cnameLabelLen characters decodes to
+		floor(cnameLabelLen*5/8) bytes. */
+		return maxCNAMELabels*(cnameLabelLen*5/8) - lenPrefixLen
+	default: /* TypeTXT and anything else. */
+		/* Each base64'd string of maxTXTStringLen characters decodes
+		to floor(maxTXTStringLen*3/4) bytes. */
+		return maxTXTStrings * (maxTXTStringLen * 3 / 4)
+	}
+}
+
+/* packAnswers packs payload into one or more dnsmessage.Resources suitable
+for answering q, per the RR type q asked for.  It's the reverse of
+client.queryTXT, client.queryAAAA and client.queryCNAME. */
+func packAnswers(q dnsmessage.Question, payload []byte) ([]dnsmessage.Resource, error) {
+	hdr := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: q.Class,
+		TTL:   tunnelAnswerTTL,
+	}
+
+	switch q.Type {
+	case dnsmessage.TypeAAAA:
+		fp := prefixLen(payload)
+		var ans []dnsmessage.Resource
+		for i := 0; len(fp) > 0; i++ {
+			if i > 255 {
+				return nil, fmt.Errorf(
+					"payload needs more than 256 AAAA records",
+				)
+			}
+			var addr [16]byte
+			addr[0] = byte(i)
+			n := copy(addr[1:], fp)
+			fp = fp[n:]
+			ans = append(ans, dnsmessage.Resource{
+				Header: hdr,
+				Body:   &dnsmessage.AAAAResource{AAAA: addr},
+			})
+		}
+		return ans, nil
+	case dnsmessage.TypeCNAME:
+		fp := prefixLen(payload)
+		var labels []string
+		for len(fp) > 0 {
+			n := cnameLabelLen * 5 / 8
+			if n > len(fp) {
+				n = len(fp)
+			}
+			labels = append(
+				labels,
+				cnameB32.EncodeToString(fp[:n]),
+			)
+			fp = fp[n:]
+		}
+		name, err := dnsmessage.NewName(strings.Join(labels, ".") + ".")
+		if nil != err {
+			return nil, fmt.Errorf("building CNAME target: %w", err)
+		}
+		return []dnsmessage.Resource{{
+			Header: hdr,
+			Body:   &dnsmessage.CNAMEResource{CNAME: name},
+		}}, nil
+	default: /* TypeTXT and anything else. */
+		enc := b64enc(payload)
+		var strs []string
+		for len(enc) > 0 {
+			n := maxTXTStringLen
+			if n > len(enc) {
+				n = len(enc)
+			}
+			strs = append(strs, enc[:n])
+			enc = enc[n:]
+		}
+		if 0 == len(strs) {
+			strs = []string{""}
+		}
+		return []dnsmessage.Resource{{
+			Header: hdr,
+			Body:   &dnsmessage.TXTResource{TXT: strs},
+		}}, nil
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+/*
+ * rrpack_test.go
+ * Tests for rrpack.go
+ * By J. Stuart McMurray
+ * Created 20260730
+ * Last Modified 20260730
+ */
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* testPayload returns an n-byte payload whose bytes count up from 0 (wrapping
+every 256 bytes), so reassembly bugs which drop, duplicate, or reorder bytes
+show up clearly. */
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+/* unpackAAAA reassembles payload bytes from AAAA answers built by
+packAnswers, mirroring client.queryAAAA's index-based reassembly (see
+rrpack.go's aaaaDataLen comment for why lookup order can't be trusted). */
+func unpackAAAA(t *testing.T, ans []dnsmessage.Resource) []byte {
+	t.Helper()
+	chunks := make(map[byte][]byte, len(ans))
+	for _, a := range ans {
+		ar, ok := a.Body.(*dnsmessage.AAAAResource)
+		if !ok {
+			t.Fatalf("answer body isn't an AAAAResource: %T", a.Body)
+		}
+		chunks[ar.AAAA[0]] = append([]byte(nil), ar.AAAA[1:]...)
+	}
+	raw := make([]byte, 0, len(chunks)*aaaaDataLen)
+	for i := 0; i < len(chunks); i++ {
+		c, ok := chunks[byte(i)]
+		if !ok {
+			t.Fatalf("missing AAAA answer for index %d", i)
+		}
+		raw = append(raw, c...)
+	}
+	return stripLenPrefix(t, raw)
+}
+
+/* unpackCNAME reassembles payload bytes from the single CNAME answer built
+by packAnswers, mirroring client.queryCNAME. */
+func unpackCNAME(t *testing.T, ans []dnsmessage.Resource) []byte {
+	t.Helper()
+	if 1 != len(ans) {
+		t.Fatalf("got %d CNAME answers, want 1", len(ans))
+	}
+	cr, ok := ans[0].Body.(*dnsmessage.CNAMEResource)
+	if !ok {
+		t.Fatalf("answer body isn't a CNAMEResource: %T", ans[0].Body)
+	}
+	target := cr.CNAME.String()
+	var raw []byte
+	for _, l := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		b, err := cnameB32.DecodeString(strings.ToUpper(l))
+		if nil != err {
+			t.Fatalf("decoding CNAME label %q: %s", l, err)
+		}
+		raw = append(raw, b...)
+	}
+	return stripLenPrefix(t, raw)
+}
+
+/* unpackTXT reassembles payload bytes from the single TXT answer built by
+packAnswers, mirroring client.queryTXT. */
+func unpackTXT(t *testing.T, ans []dnsmessage.Resource) []byte {
+	t.Helper()
+	if 1 != len(ans) {
+		t.Fatalf("got %d TXT answers, want 1", len(ans))
+	}
+	tr, ok := ans[0].Body.(*dnsmessage.TXTResource)
+	if !ok {
+		t.Fatalf("answer body isn't a TXTResource: %T", ans[0].Body)
+	}
+	b, err := base64.RawStdEncoding.DecodeString(strings.Join(tr.TXT, ""))
+	if nil != err {
+		t.Fatalf("decoding TXT: %s", err)
+	}
+	return b
+}
+
+/* stripLenPrefix undoes prefixLen, as the client side does after
+reassembling an AAAA or CNAME answer's fixed-size chunks. */
+func stripLenPrefix(t *testing.T, b []byte) []byte {
+	t.Helper()
+	if len(b) < lenPrefixLen {
+		t.Fatalf("reassembled payload too short (%d bytes)", len(b))
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[lenPrefixLen:]
+	if n > len(b) {
+		t.Fatalf("length prefix %d exceeds reassembled payload %d", n, len(b))
+	}
+	return b[:n]
+}
+
+/* TestPackAnswersMaxPayload round-trips packAnswers, at the exact payload
+size maxPayloadLen advertises as the budget, for every RR type it supports.
+This is the case that bit AAAA (payload split across multiple answers whose
+wire order can't be trusted) and CNAME (a presentation-form target over
+dnsmessage.Name's 255-byte wire limit); both are covered here so a
+regression in either fails a test instead of shipping. */
+func TestPackAnswersMaxPayload(t *testing.T) {
+	name, err := dnsmessage.NewName("abc123.tunnel.example.com.")
+	if nil != err {
+		t.Fatalf("building test name: %s", err)
+	}
+
+	for _, c := range []struct {
+		rtype  dnsmessage.Type
+		unpack func(*testing.T, []dnsmessage.Resource) []byte
+	}{
+		{dnsmessage.TypeTXT, unpackTXT},
+		{dnsmessage.TypeAAAA, unpackAAAA},
+		{dnsmessage.TypeCNAME, unpackCNAME},
+	} {
+		c := c
+		t.Run(c.rtype.String(), func(t *testing.T) {
+			q := dnsmessage.Question{
+				Name:  name,
+				Type:  c.rtype,
+				Class: dnsmessage.ClassINET,
+			}
+			payload := testPayload(maxPayloadLen(c.rtype))
+
+			ans, err := packAnswers(q, payload)
+			if nil != err {
+				t.Fatalf(
+					"packAnswers at max payload (%d bytes): %s",
+					len(payload),
+					err,
+				)
+			}
+
+			got := c.unpack(t, ans)
+			if !bytes.Equal(got, payload) {
+				t.Fatalf(
+					"round-trip mismatch: got %d bytes, want %d",
+					len(got),
+					len(payload),
+				)
+			}
+		})
+	}
+}
@@ -6,16 +6,19 @@ package server
  * Server side of dnsproxycommand
  * By J. Stuart McMurray
  * Created 20220323
- * Last Modified 20220324
+ * Last Modified 20260730
  */
 
 import (
+	"crypto/ecdh"
 	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -28,99 +31,342 @@ const (
 
 	/* ansCacheSize is the size of the answer cache. */
 	ansCacheSize = 1024 * 1024
+
+	/* defaultPruneInterval is used if Options.PruneInterval is 0. */
+	defaultPruneInterval = time.Minute
 )
 
-var (
-	/* bufPool is a pool of buffers of size bufLen. */
-	bufPool = sync.Pool{New: func() any { return make([]byte, bufLen) }}
+/* bufPool is a pool of buffers of size bufLen, shared by all Servers. */
+var bufPool = sync.Pool{New: func() any { return make([]byte, bufLen) }}
 
-	/* domainName is the domain we'll serve. */
-	domainName string
+// Options configures a Listen call, beyond the mandatory domain and laddr.
+type Options struct {
+	// PruneInterval is how often to check for abandoned connections.
+	// Defaults to defaultPruneInterval if 0.
+	PruneInterval time.Duration
+
+	// DoHListen, if set, additionally serves DoH (RFC 8484) queries on
+	// this address.
+	DoHListen string
+
+	// Cert and Key, if both set, are used for the DoH TLS listener;
+	// otherwise a certificate's obtained automatically via autocert.
+	Cert, Key string
+
+	// CryptKeyFile, if set, is this server's static private key, read
+	// from this file; an ephemeral keypair is generated (and logged) if
+	// unset.  Ignored if Insecure.
+	CryptKeyFile string
+
+	// Insecure disables the tunnel encryption layer entirely, for
+	// backward compatibility with older clients.
+	Insecure bool
+
+	// Apex configures the records answered authoritatively for the zone
+	// apex itself (SOA, NS, A, AAAA, CAA, DNSKEY), as opposed to tunnel
+	// subdomains, as well as optional forwarding to an upstream recursor
+	// (see ApexRecords).
+	Apex ApexRecords
+
+	// QueryLogFile, if set, is the path to a structured query log (see
+	// querylog.go).
+	QueryLogFile string
+
+	// QueryLogFormat selects QueryLogFile's on-disk format.  Ignored if
+	// QueryLogFile is unset.
+	QueryLogFormat QueryLogFormat
+
+	// QueryLogMaxSize is the size, in bytes, QueryLogFile's allowed to
+	// grow to before being rotated aside.  Defaults to
+	// defaultQueryLogMaxSize if 0.  Ignored if QueryLogFile is unset.
+	QueryLogMaxSize int64
 
-	/* upstreamAddr is the upstream address to which to connect. */
-	upstreamAddr string
+	// QPS is the most queries per second a single client IP may make
+	// before its queries are silently dropped.  0 (the default) disables
+	// rate limiting.
+	QPS float64
+
+	// MetricsListen, if set, additionally serves a Prometheus /metrics
+	// endpoint on this address.
+	MetricsListen string
+}
+
+// Server is a listening DPC server.  It implements net.Listener; Accept
+// returns a net.Conn per client new-connection handshake.  Dialing whatever
+// upstream service an accepted conn should be proxied to is the caller's
+// job.
+type Server struct {
+	domainName string
 
 	/* ansCache holds cached answers to queries. */
 	ansCache *lru.TwoQueueCache
-)
 
-func init() {
+	/* seenTSCache attempts to prevent replays of new-connection
+	requests. */
+	seenTSCache *lru.TwoQueueCache
+
+	/* insecure and serverKey are this Server's encryption-layer state
+	(see crypto.go). */
+	insecure  bool
+	serverKey *ecdh.PrivateKey
+
+	/* Apex zone state (see apex.go). */
+	ns               []string
+	a, aaaa          []net.IP
+	caaIssue         string
+	soaEmailOpt      string
+	apexTTL          uint32
+	soaSerial        uint32
+	upstreamRecursor string
+
+	/* conns holds this Server's live connections (see conn.go). */
+	conns      map[string]*conn
+	connNextID uint64
+	connsL     sync.RWMutex
+
+	/* qlog is this Server's structured query log, or nil if unconfigured
+	(see querylog.go). */
+	qlog *queryLog
+
+	/* qps and limiters are this Server's per-client-IP rate limiting
+	state (see ratelimit.go); limiters is nil if rate limiting's
+	disabled. */
+	qps      float64
+	limiters *lru.Cache
+
+	/* metrics holds this Server's running counters, exposed via
+	/metrics if opts.MetricsListen is set (see metrics.go). */
+	metrics metrics
+
+	pc net.PacketConn
+
+	/* dohSrv and metricsSrv are the DoH and /metrics HTTP servers started
+	by Listen, or nil if not configured.  Close closes whichever are set.
+	They're only ever written here, in Listen, before the goroutines which
+	serve them start, so reading them in Close needs no further
+	synchronization. */
+	dohSrv, metricsSrv *http.Server
+
+	acceptCh  chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen starts a DNS listener on laddr for the parent domain domain and
+// returns a Server, whose Accept method returns a net.Conn per client
+// connection.  If opts.DoHListen is non-empty, DoH (RFC 8484) queries are
+// also served on opts.DoHListen.
+func Listen(domain, laddr string, opts Options) (*Server, error) {
+	s := &Server{
+		domainName: "." + strings.Trim(domain, ".") + ".",
+		conns:      make(map[string]*conn),
+		connNextID: uint64(time.Now().UnixNano()),
+		acceptCh:   make(chan net.Conn),
+		closeCh:    make(chan struct{}),
+	}
+
 	var err error
-	ansCache, err = lru.New2Q(ansCacheSize)
+	s.ansCache, err = lru.New2Q(ansCacheSize)
 	if nil != err {
-		panic(fmt.Sprintf("making answer cache: %s", err))
+		return nil, fmt.Errorf("making answer cache: %w", err)
+	}
+	s.seenTSCache, err = lru.New2Q(tsCacheSize)
+	if nil != err {
+		return nil, fmt.Errorf("making timestamp cache: %w", err)
+	}
+
+	/* Set up the tunnel encryption layer, or disable it. */
+	if err := s.initCrypto(opts.CryptKeyFile, opts.Insecure); nil != err {
+		return nil, fmt.Errorf("initializing crypto: %w", err)
+	}
+
+	/* Set up the zone apex's authoritative records. */
+	s.parseApexOptions(opts.Apex)
+
+	/* Set up the structured query log, if we're meant to have one. */
+	if "" != opts.QueryLogFile {
+		ql, err := openQueryLog(
+			opts.QueryLogFile,
+			opts.QueryLogFormat,
+			opts.QueryLogMaxSize,
+		)
+		if nil != err {
+			return nil, fmt.Errorf("opening query log: %w", err)
+		}
+		s.qlog = ql
+	}
+
+	/* Set up per-client-IP rate limiting, if configured. */
+	if err := s.initRateLimit(opts.QPS); nil != err {
+		return nil, fmt.Errorf("initializing rate limiter: %w", err)
 	}
-}
 
-// Server listens on laddr for DNS queries for the parent domain domain and
-// proxies connections from clients to TCP connections to caddr.
-func Server(caddr, laddr, domain string, pruneInterval time.Duration) error {
 	/* Grab a socket. */
 	pc, err := net.ListenPacket("udp", laddr)
 	if nil != err {
-		return fmt.Errorf("listening on %q: %w", laddr, err)
+		return nil, fmt.Errorf("listening on %q: %w", laddr, err)
 	}
+	s.pc = pc
 	log.Printf("Listening on %s", pc.LocalAddr())
 
-	/* Work out the domain we'll serve. */
-	domainName = "." + strings.Trim(domain, ".") + "."
-
 	/* Start pruning dead conns. */
-	go pruneConns(pruneInterval)
+	pruneInterval := opts.PruneInterval
+	if 0 == pruneInterval {
+		pruneInterval = defaultPruneInterval
+	}
+	go s.pruneConns(pruneInterval)
+
+	/* Start the DoH listener, if we're meant to have one. */
+	if "" != opts.DoHListen {
+		s.dohSrv = &http.Server{Addr: opts.DoHListen}
+		go func() {
+			err := s.listenDoH(s.dohSrv, opts.Cert, opts.Key)
+			log.Printf("DoH listener died: %s", err)
+		}()
+	}
+
+	/* Start the metrics listener, if we're meant to have one. */
+	if "" != opts.MetricsListen {
+		s.metricsSrv = &http.Server{Addr: opts.MetricsListen}
+		go func() {
+			err := s.listenMetrics(s.metricsSrv)
+			log.Printf("Metrics listener died: %s", err)
+		}()
+	}
+
+	go s.readLoop()
 
-	/* Yeah, package-global :( */
-	upstreamAddr = caddr
+	return s, nil
+}
 
-	/* Pop packets, handle. */
+/* readLoop pops packets off s.pc and handles them until s.pc is closed. */
+func (s *Server) readLoop() {
 	for {
 		/* Pop a packet. */
 		b := bufPool.Get().([]byte)
-		n, addr, err := pc.ReadFrom(b)
+		n, addr, err := s.pc.ReadFrom(b)
 		if nil != err {
-			return fmt.Errorf("DNS read: %w", err)
+			log.Printf("DNS read: %s", err)
+			s.Close()
+			return
 		}
 		go func() {
-			handlePacket(pc, addr, b[:n])
+			resp := s.processQuery(addr, b[:n])
 			bufPool.Put(b)
+			if nil == resp {
+				return
+			}
+			if _, err := s.pc.WriteTo(resp, addr); nil != err {
+				log.Printf("[%s] Sending response: %s", addr, err)
+			}
 		}()
 	}
 }
 
-/* handlePacket handles a packet off the wire. */
-func handlePacket(pc net.PacketConn, addr net.Addr, b []byte) {
+// Accept waits for and returns the next client connection's net.Conn.  It
+// implements net.Listener.
+func (s *Server) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptCh:
+		return c, nil
+	case <-s.closeCh:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+// Close closes the Server's listeners and all live connections.  It
+// implements net.Listener.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		s.pc.Close()
+		if nil != s.dohSrv {
+			s.dohSrv.Close()
+		}
+		if nil != s.metricsSrv {
+			s.metricsSrv.Close()
+		}
+
+		/* Close every still-live connection; pruneConnsSince handles
+		the ones which time out on their own, but Close needs to deal
+		with the rest itself. */
+		s.connsL.Lock()
+		conns := s.conns
+		s.conns = make(map[string]*conn)
+		s.connsL.Unlock()
+		for id, c := range conns {
+			go closeConn(id, c)
+		}
+	})
+	return nil
+}
+
+// Addr returns the Server's UDP listen address.  It implements
+// net.Listener.
+func (s *Server) Addr() net.Addr { return s.pc.LocalAddr() }
+
+/* processQuery unpacks a raw, wire-format DNS query from addr, dispatches it,
+and returns the packed wire-format response, or nil if no response should be
+sent.  processQuery is the common path for both the UDP and DoH (see doh.go)
+listeners. */
+func (s *Server) processQuery(addr net.Addr, b []byte) (resp []byte) {
 	/* Unpack the packet. */
 	var msg dnsmessage.Message
 	if err := msg.Unpack(b); nil != err {
 		log.Printf("[%s] Unpacking packet: %s", addr, err)
-		return
+		return nil
 	}
 
-	/* We should get exactly one TXT query. */
+	/* We should get exactly one question. */
 	if 1 != len(msg.Questions) {
 		log.Printf(
 			"[%s] Multiple (%d) questions",
 			addr,
 			len(msg.Questions),
 		)
-		return
+		return nil
 	}
 	q := msg.Questions[0]
-	if dnsmessage.TypeTXT != q.Type {
-		return
-	}
 	qn := msg.Questions[0].Name.String()
 
 	/* Sanity-check other things. */
 	if msg.Response {
 		log.Printf("[%s] Response for %s", addr, q.Name)
-		return
+		return nil
+	}
+
+	/* Drop (don't reply to) queries over the per-client-IP rate limit,
+	before doing any real work; this server's a juicy flood-abuse target,
+	as every query triggers a TCP read/write against caddr. */
+	if !s.allowQuery(addr) {
+		return nil
 	}
 
 	/* Only care about our domain. */
-	if !strings.HasSuffix(qn, domainName) {
-		return
+	if !strings.HasSuffix(qn, s.domainName) {
+		return nil
+	}
+	qn = strings.ToLower(strings.TrimSuffix(qn, s.domainName))
+	hasEDNS := hasEDNS0(msg.Additionals)
+
+	/* An empty qn, once the domain's trimmed off, means the question's
+	for the apex itself (e.g. SOA/NS checks, mail routing, or a plain
+	A/AAAA lookup of the bare domain), not the tunnel. */
+	if "" == qn {
+		msg.Response = true
+		msg.Authoritative = true
+		resp := s.answerApex(msg, q, b, hasEDNS)
+		s.logApexQuery(addr, len(b), nil)
+		return resp
+	}
+
+	switch q.Type {
+	case dnsmessage.TypeTXT, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+		/* Ok; these are the RR types we can pack a reverse-path
+		payload into (see rrpack.go). */
+	default:
+		return nil
 	}
-	qn = strings.ToLower(strings.TrimSuffix(qn, domainName))
 
 	/* Need 1-3 labels */
 	labels := strings.Split(qn, ".")
@@ -130,7 +376,7 @@ func handlePacket(pc net.PacketConn, addr net.Addr, b []byte) {
 		log.Printf("[%s] No labels from %s", qn, addr)
 	default:
 		log.Printf("[%s] Too many labels from %s", qn, addr)
-		return
+		return nil
 	}
 
 	/* Reply to be sent back. */
@@ -142,42 +388,52 @@ func handlePacket(pc net.PacketConn, addr net.Addr, b []byte) {
 	defer func() {
 		/* Roll a response. */
 		if nil != reply {
-			msg.RCode = dnsmessage.RCodeSuccess
-			msg.Answers = append(msg.Answers, dnsmessage.Resource{
-				Header: dnsmessage.ResourceHeader{
-					Name:  q.Name,
-					Type:  q.Type,
-					Class: q.Class,
-				},
-				Body: &dnsmessage.TXTResource{TXT: []string{
-					*reply,
-				}},
-			})
+			rb, err := base64.RawStdEncoding.DecodeString(*reply)
+			if nil != err {
+				log.Printf("[%s] Decoding cached answer: %s", qn, err)
+				msg.RCode = dnsmessage.RCodeServerFailure
+			} else {
+				ans, err := packAnswers(q, rb)
+				if nil != err {
+					log.Printf(
+						"[%s] Packing %s answer: %s",
+						qn,
+						q.Type,
+						err,
+					)
+					msg.RCode = dnsmessage.RCodeServerFailure
+				} else {
+					msg.RCode = dnsmessage.RCodeSuccess
+					msg.Answers = append(msg.Answers, ans...)
+				}
+			}
 		} else {
 			msg.RCode = dnsmessage.RCodeNameError
 		}
+		if hasEDNS {
+			addEDNS0(&msg)
+		}
 		b, err := msg.Pack()
 		if nil != err {
 			log.Printf("[%s] Packing response: %s", qn, err)
 			return
 		}
-		/* Send it back. */
-		if _, err := pc.WriteTo(b, addr); nil != err {
-			log.Printf(
-				"[%s] Sending response to %s: %s",
-				qn,
-				addr,
-				err,
-			)
-		}
+		resp = b
 	}()
 
 	/* If we've got a cached answer, use that. */
 	if 2 == len(labels) {
-		if ca, ok := ansCache.Get(qn); ok {
+		if ca, ok := s.ansCache.Get(qn); ok {
 			reply = ca.(*string)
+			atomic.AddUint64(&s.metrics.cacheHits, 1)
+			plen := 0
+			if db, derr := base64.RawStdEncoding.DecodeString(*reply); nil == derr {
+				plen = len(db)
+			}
+			s.logQuery(addr, labels, true, plen, nil)
 			return
 		}
+		atomic.AddUint64(&s.metrics.cacheMisses, 1)
 	}
 
 	/* First label tells us what to do. */
@@ -187,11 +443,11 @@ func handlePacket(pc net.PacketConn, addr net.Addr, b []byte) {
 	)
 	switch len(labels) {
 	case 1: /* New connection: timestamp. */
-		rb, err = handleNewConn(labels[0])
+		rb, err = s.handleNewConn(labels[0])
 	case 2: /* Proxy reverse: counter.id. */
-		rb, err = handleReverse(labels[0], labels[1])
+		rb, err = s.handleReverse(labels[0], labels[1], maxPayloadLen(q.Type))
 	case 3: /* Proxy forward: counter.data.id. */
-		rb, err = handleForward(labels[0], labels[1], labels[2])
+		rb, err = s.handleForward(labels[0], labels[1], labels[2])
 	default:
 		panic(fmt.Sprintf(
 			"unpossible number of labels in %s: %d",
@@ -201,9 +457,11 @@ func handlePacket(pc net.PacketConn, addr net.Addr, b []byte) {
 	}
 	if nil != err {
 		log.Printf("[%s] Error from %s: %s", qn, addr, err)
+		s.logQuery(addr, labels, false, 0, err)
 		return
 	}
 	if nil == rb {
+		s.logQuery(addr, labels, false, 0, nil)
 		return
 	}
 
@@ -211,6 +469,8 @@ func handlePacket(pc net.PacketConn, addr net.Addr, b []byte) {
 	r := base64.RawStdEncoding.EncodeToString(rb)
 	reply = &r
 	if 2 == len(labels) {
-		ansCache.Add(qn, &r)
+		s.ansCache.Add(qn, &r)
 	}
+	s.logQuery(addr, labels, false, len(rb), nil)
+	return
 }